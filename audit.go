@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ======================
+// 📜 Audit Log
+// ======================
+
+const auditPrefix = "audit/"
+
+// AuditEntry is one line of the daily audit object.
+type AuditEntry struct {
+	Action     string `json:"action"`
+	Filename   string `json:"filename"`
+	MessageID  int    `json:"messageId,omitempty"`
+	MessageIDs []int  `json:"messageIds,omitempty"` // Batch actions
+	Subject    string `json:"subject,omitempty"`    // JWT "sub", when authenticated
+	Timestamp  string `json:"timestamp"`
+}
+
+// auditKey partitions the log by UTC day, e.g. audit/2024-01-15.jsonl.
+func auditKey(t time.Time) string {
+	return auditPrefix + t.UTC().Format("2006-01-02") + ".jsonl"
+}
+
+// recordAudit appends an entry for a completed write. Failures are logged
+// only; the write itself already succeeded.
+func recordAudit(ctx context.Context, entry AuditEntry) {
+	now := time.Now().UTC()
+	entry.Subject = subjectFrom(ctx)
+	entry.Timestamp = now.Format(time.RFC3339)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		loggerFrom(ctx).Error("audit marshal failed", "error", err)
+		return
+	}
+
+	if err := store.Append(ctx, auditKey(now), append(line, '\n')); err != nil {
+		loggerFrom(ctx).Error("audit write failed", "action", entry.Action, "filename", entry.Filename, "error", err)
+	}
+}
+
+// ======================
+// ➕ S3: Append Line
+// ======================
+
+// appendS3Object appends data to a plain-text object. S3 has no append, so
+// this is a conditional read-modify-write retried on concurrent appends.
+func appendS3Object(ctx context.Context, s3Client *s3.Client, bucket, s3Key string, data []byte) error {
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		existing, etag, err := readS3Object(ctx, s3Client, bucket, s3Key)
+		if err != nil {
+			return err
+		}
+
+		input := &s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(s3Key),
+			Body:        bytes.NewReader(append(existing, data...)),
+			ContentType: aws.String("application/x-ndjson"),
+		}
+		if etag != "" {
+			input.IfMatch = aws.String(etag)
+		} else {
+			input.IfNoneMatch = aws.String("*") // Someone else may create it first
+		}
+		applyServerSideEncryption(input)
+
+		_, err = s3Client.PutObject(ctx, input)
+		if err == nil {
+			return nil
+		}
+		if !isS3PreconditionErr(err) {
+			return fmt.Errorf("put failed: %v", err)
+		}
+	}
+
+	return errConcurrentModification
+}
+
+// readS3Object returns an object's raw bytes and ETag; empty when missing.
+func readS3Object(ctx context.Context, s3Client *s3.Client, bucket, s3Key string) ([]byte, string, error) {
+	resp, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(s3Key),
+	})
+	if err != nil {
+		if isS3NotFoundErr(err) {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("get failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("read failed: %v", err)
+	}
+	return data, aws.ToString(resp.ETag), nil
+}
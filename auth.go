@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ======================
+// 🔐 JWT Auth
+// ======================
+
+// jwtSecret is the HMAC key for bearer tokens; auth is disabled when empty.
+var jwtSecret string
+
+type subjectKey struct{}
+
+func withSubject(ctx context.Context, sub string) context.Context {
+	return context.WithValue(ctx, subjectKey{}, sub)
+}
+
+// subjectFrom returns the authenticated "sub" claim, or "" without auth.
+func subjectFrom(ctx context.Context) string {
+	sub, _ := ctx.Value(subjectKey{}).(string)
+	return sub
+}
+
+// authenticate validates the bearer token in headers and returns its subject
+// and role claim (see roleClaim); the role may be empty.
+func authenticate(headers map[string]string) (sub, role string, err error) {
+	authHeader := headerValue(headers, "Authorization")
+	if authHeader == "" {
+		return "", "", errors.New("missing bearer token")
+	}
+
+	tokenString, ok := strings.CutPrefix(authHeader, "Bearer ")
+	if !ok || tokenString == "" {
+		return "", "", errors.New("missing bearer token")
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(tokenString, claims, func(*jwt.Token) (interface{}, error) {
+		return []byte(jwtSecret), nil
+	}, jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"}))
+	if err != nil {
+		return "", "", errors.New("invalid token")
+	}
+
+	sub, err = claims.GetSubject()
+	if err != nil || sub == "" {
+		return "", "", errors.New("token has no subject")
+	}
+
+	role, _ = claims[roleClaim].(string)
+	return sub, role, nil
+}
+
+// withCaller authenticates the request when auth is on (JWT_SECRET) and
+// returns ctx carrying the caller's subject, role and a logger tagged with
+// both. Handler and the Gin routes share it so neither can skip auth.
+func withCaller(ctx context.Context, headers map[string]string) (context.Context, error) {
+	if jwtSecret == "" {
+		return ctx, nil
+	}
+	sub, role, err := authenticate(headers)
+	if err != nil {
+		return ctx, err
+	}
+	logger := loggerFrom(ctx).With("sub", sub, "role", role)
+	return withLogger(withRole(withSubject(ctx, sub), role), logger), nil
+}
+
+// headerValue looks up a header case-insensitively; API Gateway passes them
+// through as the client sent them.
+func headerValue(headers map[string]string, name string) string {
+	if v, ok := headers[name]; ok {
+		return v
+	}
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
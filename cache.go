@@ -0,0 +1,90 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// ======================
+// 🧊 LRU Cache
+// ======================
+
+// messageCache holds recently read files; nil disables caching.
+var messageCache *lruCache
+
+type cacheEntry struct {
+	key      string
+	messages AllMessages
+	meta     ObjectMeta
+}
+
+// lruCache maps "bucket/key" to the decoded contents and object metadata. It
+// is safe for concurrent use and returns copies so callers can mutate freely.
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // Front = most recently used
+	entries map[string]*list.Element
+}
+
+func newLRUCache(size int) *lruCache {
+	if size <= 0 {
+		return nil
+	}
+	return &lruCache{
+		size:    size,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func (c *lruCache) Get(key string) (AllMessages, ObjectMeta, bool) {
+	if c == nil {
+		return nil, ObjectMeta{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, ObjectMeta{}, false
+	}
+	c.order.MoveToFront(el)
+	entry := el.Value.(*cacheEntry)
+	return append(AllMessages{}, entry.messages...), entry.meta, true
+}
+
+func (c *lruCache) Put(key string, messages AllMessages, meta ObjectMeta) {
+	if c == nil || meta.ETag == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{key: key, messages: append(AllMessages{}, messages...), meta: meta}
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *lruCache) Remove(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+}
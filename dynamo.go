@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ======================
+// 🗃️ DynamoDB Store
+// ======================
+
+// DynamoStore keeps one item per message in a table keyed by
+// (filename, id), so add/update/delete write a single item instead of
+// rewriting the whole file. Each file also has a header item at id 0 that
+// carries its version (the "ETag" for conditional writes) and modification
+// time. Append-only objects such as the audit log store one item per line.
+type DynamoStore struct {
+	client *dynamodb.Client
+	table  string
+}
+
+func NewDynamoStore(client *dynamodb.Client, table string) *DynamoStore {
+	return &DynamoStore{client: client, table: table}
+}
+
+// headerID is the sort key of a file's header item; message IDs start at 1.
+const headerID = 0
+
+// DynamoDB caps a transaction at 100 items; one slot goes to the header.
+const maxTransactItems = 100
+
+// Messages are stored with their JSON field names so the table reads like
+// the S3 files.
+func marshalDynamoOptions(o *attributevalue.EncoderOptions)   { o.TagKey = "json" }
+func unmarshalDynamoOptions(o *attributevalue.DecoderOptions) { o.TagKey = "json" }
+
+func dynamoKey(key string, id int) map[string]ddbtypes.AttributeValue {
+	return map[string]ddbtypes.AttributeValue{
+		"filename": &ddbtypes.AttributeValueMemberS{Value: key},
+		"id":       &ddbtypes.AttributeValueMemberN{Value: strconv.Itoa(id)},
+	}
+}
+
+// dynamoErr wraps a failed DynamoDB call. One cut short by the action's
+// deadline is ErrStorageTimeout, as in S3Store.call, so it maps to a 504.
+func dynamoErr(ctx context.Context, op string, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrStorageTimeout
+	}
+	return fmt.Errorf("dynamodb %s failed: %w", op, err)
+}
+
+type dynamoHeader struct {
+	Version  int    `dynamodbav:"version"`
+	Modified string `dynamodbav:"modified"`
+	Size     int64  `dynamodbav:"size"` // JSON bytes, reported by List
+}
+
+func (h dynamoHeader) meta() ObjectMeta {
+	if h.Version == 0 {
+		return ObjectMeta{}
+	}
+	modified, _ := time.Parse(time.RFC3339Nano, h.Modified)
+	return ObjectMeta{ETag: strconv.Itoa(h.Version), LastModified: modified}
+}
+
+// query pages through a file's items in ID order, header first.
+func (d *DynamoStore) query(ctx context.Context, key string, visit func(map[string]ddbtypes.AttributeValue) error) error {
+	paginator := dynamodb.NewQueryPaginator(d.client, &dynamodb.QueryInput{
+		TableName:              aws.String(d.table),
+		KeyConditionExpression: aws.String("filename = :f"),
+		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
+			":f": &ddbtypes.AttributeValueMemberS{Value: key},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return dynamoErr(ctx, "query", err)
+		}
+		for _, item := range page.Items {
+			if err := visit(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// load reads the header and every message of a file.
+func (d *DynamoStore) load(ctx context.Context, key string) (AllMessages, dynamoHeader, error) {
+	messages := AllMessages{}
+	var header dynamoHeader
+	err := d.query(ctx, key, func(item map[string]ddbtypes.AttributeValue) error {
+		if n, ok := item["id"].(*ddbtypes.AttributeValueMemberN); ok && n.Value == strconv.Itoa(headerID) {
+			return attributevalue.UnmarshalMap(item, &header)
+		}
+		var m Message
+		if err := attributevalue.UnmarshalMapWithOptions(item, &m, unmarshalDynamoOptions); err != nil {
+			return fmt.Errorf("dynamodb decode failed: %v", err)
+		}
+		messages = append(messages, m)
+		return nil
+	})
+	return messages, header, err
+}
+
+func (d *DynamoStore) Get(ctx context.Context, key string) (AllMessages, ObjectMeta, error) {
+	messages, header, err := d.load(ctx, key)
+	if err != nil {
+		return nil, ObjectMeta{}, err
+	}
+	return messages, header.meta(), nil
+}
+
+// Put writes only the messages that differ from what's stored. The header's
+// version is bumped in the same transaction, conditional on the version the
+// caller read, so concurrent writers get ErrPreconditionFailed as with S3.
+func (d *DynamoStore) Put(ctx context.Context, key string, messages AllMessages, version string) error {
+	current, header, err := d.load(ctx, key)
+	if err != nil {
+		return err
+	}
+	if version == versionAbsent && header.Version != 0 {
+		return ErrPreconditionFailed
+	}
+	if version != "" && version != versionAbsent && version != header.meta().ETag {
+		return ErrPreconditionFailed
+	}
+	return d.write(ctx, key, current, header.Version, messages)
+}
+
+// PutDiff is Put without the reload: previous is what Get returned at
+// version. The header condition still refuses the write if the file has
+// moved on since.
+func (d *DynamoStore) PutDiff(ctx context.Context, key string, previous, messages AllMessages, version string) error {
+	read := 0
+	if version != "" {
+		v, err := strconv.Atoi(version)
+		if err != nil {
+			return ErrPreconditionFailed
+		}
+		read = v
+	}
+	return d.write(ctx, key, previous, read, messages)
+}
+
+// write stores messages over current, the file's contents at version read
+// (0 when it doesn't exist yet), writing only the items that changed.
+func (d *DynamoStore) write(ctx context.Context, key string, current AllMessages, read int, messages AllMessages) error {
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return fmt.Errorf("marshal failed: %v", err)
+	}
+
+	stored := make(map[int]Message, len(current))
+	for _, m := range current {
+		stored[m.ID] = m
+	}
+
+	var writes []ddbtypes.TransactWriteItem
+	for _, m := range messages {
+		if old, ok := stored[m.ID]; ok && old == m {
+			delete(stored, m.ID)
+			continue
+		}
+		delete(stored, m.ID)
+
+		item, err := attributevalue.MarshalMapWithOptions(m, marshalDynamoOptions)
+		if err != nil {
+			return fmt.Errorf("dynamodb encode failed: %v", err)
+		}
+		item["filename"] = &ddbtypes.AttributeValueMemberS{Value: key}
+		writes = append(writes, ddbtypes.TransactWriteItem{
+			Put: &ddbtypes.Put{TableName: aws.String(d.table), Item: item},
+		})
+	}
+	for id := range stored {
+		writes = append(writes, ddbtypes.TransactWriteItem{
+			Delete: &ddbtypes.Delete{TableName: aws.String(d.table), Key: dynamoKey(key, id)},
+		})
+	}
+
+	headerUpdate := ddbtypes.TransactWriteItem{Update: &ddbtypes.Update{
+		TableName:        aws.String(d.table),
+		Key:              dynamoKey(key, headerID),
+		UpdateExpression: aws.String("SET version = :next, modified = :now, #size = :size"),
+		// SIZE is a DynamoDB reserved word
+		ExpressionAttributeNames: map[string]string{"#size": "size"},
+		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
+			":next": &ddbtypes.AttributeValueMemberN{Value: strconv.Itoa(read + 1)},
+			":now":  &ddbtypes.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339Nano)},
+			":size": &ddbtypes.AttributeValueMemberN{Value: strconv.Itoa(len(data))},
+		},
+	}}
+	if read == 0 {
+		headerUpdate.Update.ConditionExpression = aws.String("attribute_not_exists(version)")
+	} else {
+		headerUpdate.Update.ConditionExpression = aws.String("version = :read")
+		headerUpdate.Update.ExpressionAttributeValues[":read"] = &ddbtypes.AttributeValueMemberN{Value: strconv.Itoa(read)}
+	}
+
+	// Large rewrites (import, replace) can't fit one transaction: claim the
+	// version first, then write the rest in chunks. A failure part-way
+	// leaves the file partially written, as a crashed S3 writer can't.
+	for start := 0; start == 0 || start < len(writes); start += maxTransactItems - 1 {
+		end := min(start+maxTransactItems-1, len(writes))
+		items := writes[start:end]
+		if start == 0 {
+			items = append([]ddbtypes.TransactWriteItem{headerUpdate}, items...)
+		}
+
+		_, err := d.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+		var cancelled *ddbtypes.TransactionCanceledException
+		if start == 0 && errors.As(err, &cancelled) {
+			return ErrPreconditionFailed
+		}
+		if err != nil {
+			return dynamoErr(ctx, "write", err)
+		}
+	}
+	return nil
+}
+
+func (d *DynamoStore) Scan(ctx context.Context, key string, keep func(Message) bool) (AllMessages, error) {
+	matches := AllMessages{}
+	err := d.query(ctx, key, func(item map[string]ddbtypes.AttributeValue) error {
+		if n, ok := item["id"].(*ddbtypes.AttributeValueMemberN); ok && n.Value == strconv.Itoa(headerID) {
+			return nil
+		}
+		var m Message
+		if err := attributevalue.UnmarshalMapWithOptions(item, &m, unmarshalDynamoOptions); err != nil {
+			return fmt.Errorf("dynamodb decode failed: %v", err)
+		}
+		if keep(m) {
+			matches = append(matches, m)
+		}
+		return nil
+	})
+	return matches, err
+}
+
+// Copy rewrites src's messages under dst through Put, so the destination
+// gets a fresh version like any other write.
+func (d *DynamoStore) Copy(ctx context.Context, src, dst string, overwrite bool) error {
+	messages, header, err := d.load(ctx, src)
+	if err != nil {
+		return err
+	}
+	if header.Version == 0 {
+		return ErrFileNotFound
+	}
+
+	dstHeader, err := d.head(ctx, dst)
+	if err != nil {
+		return err
+	}
+	if dstHeader.Version != 0 && !overwrite {
+		return ErrFileExists
+	}
+	return d.Put(ctx, dst, messages, dstHeader.meta().ETag)
+}
+
+// DynamoDB caps a batch write at 25 requests.
+const maxBatchWriteItems = 25
+
+// Delete removes the header and every message item of a file.
+func (d *DynamoStore) Delete(ctx context.Context, key string) error {
+	messages, header, err := d.load(ctx, key)
+	if err != nil {
+		return err
+	}
+	if header.Version == 0 {
+		return ErrFileNotFound
+	}
+
+	ids := []int{headerID}
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	for start := 0; start < len(ids); start += maxBatchWriteItems {
+		var requests []ddbtypes.WriteRequest
+		for _, id := range ids[start:min(start+maxBatchWriteItems, len(ids))] {
+			requests = append(requests, ddbtypes.WriteRequest{
+				DeleteRequest: &ddbtypes.DeleteRequest{Key: dynamoKey(key, id)},
+			})
+		}
+
+		// Throttled deletes come back as unprocessed; resubmit until done
+		pending := map[string][]ddbtypes.WriteRequest{d.table: requests}
+		for len(pending) > 0 {
+			resp, err := d.client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{RequestItems: pending})
+			if err != nil {
+				return dynamoErr(ctx, "delete", err)
+			}
+			pending = resp.UnprocessedItems
+		}
+	}
+	return nil
+}
+
+// Tail reads the whole partition for now; the keep filter rules out a
+// simple reverse query with a limit.
+func (d *DynamoStore) Tail(ctx context.Context, key string, n int, keep func(Message) bool) (AllMessages, error) {
+	matches, err := d.Scan(ctx, key, keep)
+	if err != nil {
+		return nil, err
+	}
+	return lastMessages(matches, n), nil
+}
+
+func (d *DynamoStore) head(ctx context.Context, key string) (dynamoHeader, error) {
+	resp, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.table),
+		Key:            dynamoKey(key, headerID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return dynamoHeader{}, dynamoErr(ctx, "get", err)
+	}
+
+	var header dynamoHeader
+	if resp.Item != nil {
+		if err := attributevalue.UnmarshalMap(resp.Item, &header); err != nil {
+			return dynamoHeader{}, fmt.Errorf("dynamodb decode failed: %v", err)
+		}
+	}
+	return header, nil
+}
+
+func (d *DynamoStore) Head(ctx context.Context, key string) (ObjectMeta, error) {
+	header, err := d.head(ctx, key)
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	return header.meta(), nil
+}
+
+// List scans header items, which is fine for the handful of files per user
+// this backend targets.
+func (d *DynamoStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	paginator := dynamodb.NewScanPaginator(d.client, &dynamodb.ScanInput{
+		TableName:                aws.String(d.table),
+		FilterExpression:         aws.String("id = :h AND begins_with(filename, :p) AND attribute_exists(version)"),
+		ProjectionExpression:     aws.String("filename, modified, #size"),
+		ExpressionAttributeNames: map[string]string{"#size": "size"},
+		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
+			":h": &ddbtypes.AttributeValueMemberN{Value: strconv.Itoa(headerID)},
+			":p": &ddbtypes.AttributeValueMemberS{Value: prefix},
+		},
+	})
+
+	objects := []ObjectInfo{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, dynamoErr(ctx, "scan", err)
+		}
+		for _, item := range page.Items {
+			var entry struct {
+				Filename string `dynamodbav:"filename"`
+				dynamoHeader
+			}
+			if err := attributevalue.UnmarshalMap(item, &entry); err != nil {
+				return nil, fmt.Errorf("dynamodb decode failed: %v", err)
+			}
+			modified, _ := time.Parse(time.RFC3339Nano, entry.Modified)
+			objects = append(objects, ObjectInfo{Key: entry.Filename, Size: entry.Size, LastModified: modified})
+		}
+	}
+	// Match S3's lexicographic listing
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// Append stores data as its own item under the key, with the write time in
+// nanoseconds as its sort key. A list on one item would hit the 400 KB item
+// cap after a few thousand audit entries a day; separate items don't, and
+// still read back in order with a query on the key.
+func (d *DynamoStore) Append(ctx context.Context, key string, data []byte) error {
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		_, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(d.table),
+			Item: map[string]ddbtypes.AttributeValue{
+				"filename": &ddbtypes.AttributeValueMemberS{Value: key},
+				"id":       &ddbtypes.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().UnixNano(), 10)},
+				"line":     &ddbtypes.AttributeValueMemberS{Value: string(data)},
+			},
+			// Two writers in the same nanosecond: the loser retries
+			ConditionExpression: aws.String("attribute_not_exists(id)"),
+		})
+		var taken *ddbtypes.ConditionalCheckFailedException
+		if errors.As(err, &taken) {
+			continue
+		}
+		if err != nil {
+			return dynamoErr(ctx, "append", err)
+		}
+		return nil
+	}
+	return errConcurrentModification
+}
+
+func (d *DynamoStore) Ping(ctx context.Context) error {
+	_, err := d.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(d.table)})
+	if err != nil {
+		return dynamoErr(ctx, "describe", err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ======================
+// 📥 Import Parsing
+// ======================
+
+// Parsers return the messages, or the validation problems of the first
+// invalid row keyed by its position. IDs are the source file's, only kept so
+// import can remap parentIds; import renumbers every message.
+
+func parseJSONImport(raw []byte) (AllMessages, map[string]string, error) {
+	var messages AllMessages
+	if err := json.Unmarshal(raw, &messages); err != nil {
+		return nil, nil, err
+	}
+
+	for i := range messages {
+		clearServerFields(&messages[i])
+		if fields := validateMessage(&messages[i]); fields != nil {
+			return nil, prefixFields(fields, fmt.Sprintf("messages[%d].", i)), nil
+		}
+	}
+	return messages, nil, nil
+}
+
+// parseCSVImport reads the layout written by export: a header row naming the
+// columns (any order, "id" ignored) followed by one message per row.
+func parseCSVImport(raw []byte) (AllMessages, map[string]string, error) {
+	r := csv.NewReader(bytes.NewReader(raw))
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("read header: %v", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"sender", "receiver", "message", "date"} {
+		if _, ok := columns[name]; !ok {
+			return nil, nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+
+	messages := AllMessages{}
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		m := Message{
+			Sender:   row[columns["sender"]],
+			Receiver: row[columns["receiver"]],
+			Message:  row[columns["message"]],
+			Date:     row[columns["date"]],
+		}
+		if fields := validateMessage(&m); fields != nil {
+			line, _ := r.FieldPos(0)
+			return nil, prefixFields(fields, fmt.Sprintf("line %d: ", line)), nil
+		}
+		messages = append(messages, m)
+	}
+	return messages, nil, nil
+}
+
+func prefixFields(fields map[string]string, prefix string) map[string]string {
+	prefixed := map[string]string{}
+	for name, problem := range fields {
+		prefixed[prefix+name] = problem
+	}
+	return prefixed
+}
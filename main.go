@@ -1,21 +1,54 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"maps"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 	"github.com/awslabs/aws-lambda-go-api-proxy/gin"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // ======================
@@ -28,6 +61,18 @@ type Message struct {
 	Receiver string `json:"receiver" binding:"required"`
 	Message  string `json:"message" binding:"required"`
 	Date     string `json:"date" binding:"required"`
+	Deleted  bool   `json:"deleted,omitempty"` // Tombstone: kept for audit, hidden from reads
+	// Set by add when the client sent an idempotency key; cleared once expired
+	IdempotencyKey     string `json:"idempotencyKey,omitempty"`
+	IdempotencyExpires string `json:"idempotencyExpires,omitempty"`
+	ParentID           int    `json:"parentId,omitempty"` // Message this one replies to
+	// Opaque public ID, set when ID_STRATEGY=uuid; ID stays the internal sequence
+	UUID string `json:"uuid,omitempty"`
+	// The parent's UUID with ID_STRATEGY=uuid, kept in step with ParentID
+	ParentUUID string `json:"parentUuid,omitempty"`
+	// Server-set RFC3339 times, independent of the client's Date
+	CreatedAt string `json:"createdAt,omitempty"`
+	UpdatedAt string `json:"updatedAt,omitempty"`
 }
 
 type AllMessages []Message
@@ -37,218 +82,4114 @@ type AllMessages []Message
 // ======================
 
 var (
-	bucketName string
+	bucketName string // Default bucket (S3_BUCKET_NAME)
 	ginLambda  *ginadapter.GinLambda
+
+	// Buckets a request may target via "bucket" (ALLOWED_BUCKETS, comma-separated)
+	allowedBuckets = map[string]bool{}
+
+	// Cache-Control stored on written objects, for CloudFront/static hosting
+	s3CacheControl string
+
+	// STORE_BACKEND: "s3" (default) or "dynamodb", which needs DYNAMODB_TABLE
+	storeBackend string
+	dynamoTable  string
+
+	// ID_STRATEGY: "sequential" (default) or "uuid", which also gives new
+	// messages a random public UUID
+	idStrategy = "sequential"
+
+	// Used when a request names no file (DEFAULT_FILENAME); empty requires one
+	defaultFilename string
+
+	// READ_ONLY=true rejects every mutating action (public read replicas)
+	readOnly bool
+
+	// CONTENT_TYPE_CHECK=false accepts bodies sent with any Content-Type
+	checkContentType = true
+)
+
+// writeActions are refused in read-only mode.
+var writeActions = map[string]bool{
+	"add":           true,
+	"addMany":       true,
+	"upsert":        true,
+	"import":        true,
+	"replace":       true,
+	"update":        true,
+	"patch":         true,
+	"updateWhere":   true,
+	"delete":        true,
+	"deleteMany":    true,
+	"presignUpload": true,
+	"deleteFile":    true,
+	"rename":        true,
+	"createFile":    true,
+	"archive":       true,
+}
+
+// readActions are the rest of dispatch's actions.
+var readActions = map[string]bool{
+	"get":      true,
+	"getById":  true,
+	"thread":   true,
+	"tail":     true,
+	"distinct": true,
+	"count":    true,
+	"search":   true,
+	"export":   true,
+	"presign":  true,
+	"list":     true,
+	"health":   true,
+}
+
+func init() {
+	err := godotenv.Load(".env")
+	if err != nil {
+		log.Println("⚠️ .env file not found, using OS environment variables")
+	}
+
+	bucketName = os.Getenv("S3_BUCKET_NAME")
+	if bucketName == "" {
+		log.Fatalf("❌ S3_BUCKET_NAME environment variable not set")
+	}
+
+	s3CacheControl = os.Getenv("S3_CACHE_CONTROL")
+	quarantineCorrupt = os.Getenv("QUARANTINE_CORRUPT_FILES") == "true"
+	readOnly = os.Getenv("READ_ONLY") == "true"
+	checkContentType = os.Getenv("CONTENT_TYPE_CHECK") != "false"
+	jsonPretty = os.Getenv("JSON_PRETTY") != "false"
+	defaultFilename = os.Getenv("DEFAULT_FILENAME")
+	if defaultFilename != "" {
+		if err := validateFilename(defaultFilename); err != nil {
+			log.Fatalf("❌ DEFAULT_FILENAME is invalid: %v", err)
+		}
+	}
+	if v := os.Getenv("ID_STRATEGY"); v != "" {
+		if v != "sequential" && v != "uuid" {
+			log.Fatalf("❌ ID_STRATEGY must be sequential or uuid")
+		}
+		idStrategy = v
+	}
+
+	stagedWrites = os.Getenv("S3_STAGED_WRITES") == "true"
+	partitionByDate = os.Getenv("PARTITION_BY_DATE") == "true"
+
+	s3SSE = os.Getenv("S3_SSE")
+	s3KMSKeyID = os.Getenv("S3_KMS_KEY_ID")
+	switch types.ServerSideEncryption(s3SSE) {
+	case "", types.ServerSideEncryptionAes256, types.ServerSideEncryptionAwsKms:
+	default:
+		log.Fatalf("❌ S3_SSE must be AES256 or aws:kms")
+	}
+	for _, b := range strings.Split(os.Getenv("ALLOWED_BUCKETS"), ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			allowedBuckets[b] = true
+		}
+	}
+
+	jwtSecret = os.Getenv("JWT_SECRET")
+	if origin := os.Getenv("CORS_ALLOW_ORIGIN"); origin != "" {
+		corsAllowOrigin = origin
+	}
+
+	cacheSize := 100
+	if v := os.Getenv("CACHE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("❌ CACHE_SIZE must be an integer: %v", err)
+		}
+		cacheSize = n // 0 disables the cache
+	}
+	messageCache = newLRUCache(cacheSize)
+
+	loadRecordConfig()
+	loadSchemaConfig()
+	loadRateLimitConfig()
+	loadPermissionConfig()
+
+	if v := os.Getenv("PRESIGN_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl <= 0 || ttl > 7*24*time.Hour {
+			log.Fatalf("❌ PRESIGN_TTL must be a duration up to 168h, like 15m")
+		}
+		presignTTL = ttl
+	}
+
+	if v := os.Getenv("DEDUP_WINDOW"); v != "" {
+		window, err := time.ParseDuration(v)
+		if err != nil || window < 0 {
+			log.Fatalf("❌ DEDUP_WINDOW must be a duration like 1m: %v", err)
+		}
+		dedupWindow = window
+	}
+
+	tagSubjectKey = os.Getenv("TAG_SUBJECT_KEY")
+	if tagSubjectKey != "" {
+		if err := validateTags(map[string]string{tagSubjectKey: ""}); err != nil {
+			log.Fatalf("❌ TAG_SUBJECT_KEY: %v", err)
+		}
+	}
+
+	if v := os.Getenv("IDEMPOTENCY_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("❌ IDEMPOTENCY_TTL must be a duration like 24h: %v", err)
+		}
+		idempotencyTTL = ttl
+	}
+
+	if v := os.Getenv("MAX_FILE_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("❌ MAX_FILE_BYTES must be a positive integer")
+		}
+		maxFileBytes = n
+	}
+
+	if v := os.Getenv("MAX_MESSAGES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("❌ MAX_MESSAGES must be a positive integer")
+		}
+		maxMessages = n
+	}
+
+	if v := os.Getenv("MAX_MESSAGES_WARN_PERCENT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			log.Fatalf("❌ MAX_MESSAGES_WARN_PERCENT must be between 1 and 100")
+		}
+		maxMessagesWarnPercent = n
+	}
+
+	if v := os.Getenv("MAX_BODY_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("❌ MAX_BODY_BYTES must be a positive integer")
+		}
+		maxBodyBytes = n
+	}
+
+	if v := os.Getenv("S3_TIMEOUT_MS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("❌ S3_TIMEOUT_MS must be a positive integer")
+		}
+		s3Timeout = time.Duration(n) * time.Millisecond
+	}
+
+	loadActionTimeouts()
+
+	if v := os.Getenv("S3_MAX_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("❌ S3_MAX_ATTEMPTS must be a positive integer")
+		}
+		s3MaxAttempts = n
+	}
+
+	if v := os.Getenv("LISTEN_ADDR"); v != "" {
+		if _, port, err := net.SplitHostPort(v); err != nil || port == "" {
+			log.Fatalf("❌ LISTEN_ADDR must be host:port or :port, e.g. :8080")
+		}
+		listenAddr = v
+	}
+
+	s3EndpointURL = os.Getenv("AWS_ENDPOINT_URL")
+	s3BucketRegion = os.Getenv("S3_BUCKET_REGION")
+	s3FailoverRegion = os.Getenv("S3_FAILOVER_REGION")
+	s3FailoverBucket = os.Getenv("S3_FAILOVER_BUCKET")
+	if s3FailoverBucket != "" && s3FailoverRegion == "" {
+		log.Fatalf("❌ S3_FAILOVER_BUCKET requires S3_FAILOVER_REGION")
+	}
+
+	storeBackend = os.Getenv("STORE_BACKEND")
+	switch storeBackend {
+	case "", "s3":
+	case "dynamodb":
+		dynamoTable = os.Getenv("DYNAMODB_TABLE")
+		if dynamoTable == "" {
+			log.Fatalf("❌ DYNAMODB_TABLE must be set when STORE_BACKEND=dynamodb")
+		}
+	default:
+		log.Fatalf("❌ STORE_BACKEND must be s3 or dynamodb")
+	}
+
+	// JSON lines are searchable by field in CloudWatch Logs Insights
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+}
+
+// ======================
+// 🪵 Logging
+// ======================
+
+type loggerKey struct{}
+
+// withLogger attaches a request-scoped logger so S3 helpers log with the same
+// correlation ID as the handler.
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+type bucketKey struct{}
+
+// withBucket overrides the bucket for one request; S3 helpers take it as a
+// parameter, resolved by S3Store via bucketFrom.
+func withBucket(ctx context.Context, bucket string) context.Context {
+	return context.WithValue(ctx, bucketKey{}, bucket)
+}
+
+func bucketFrom(ctx context.Context) string {
+	if bucket, ok := ctx.Value(bucketKey{}).(string); ok && bucket != "" {
+		return bucket
+	}
+	return bucketName
+}
+
+const dataPrefix = "data/"
+
+// ownerPrefix isolates an authenticated user's files under users/<sub>/.
+// Without auth (owner == "") files keep the flat layout.
+func ownerPrefix(owner string) string {
+	if owner == "" {
+		return ""
+	}
+	return "users/" + url.PathEscape(owner) + "/"
+}
+
+func buildS3Key(owner, filename string) string {
+	return ownerPrefix(owner) + filename + ".json"
+}
+
+// filenameFromKey reverses dataPrefix + buildS3Key for owner; ok is false for
+// keys that aren't that owner's message files.
+func filenameFromKey(key, owner string) (string, bool) {
+	prefix := dataPrefix + ownerPrefix(owner)
+	if !strings.HasPrefix(key, prefix) || !strings.HasSuffix(key, ".json") {
+		return "", false
+	}
+
+	name := strings.TrimSuffix(strings.TrimPrefix(key, prefix), ".json")
+	if strings.Contains(name, "/") {
+		return "", false // Nested key, e.g. another user's file in flat mode
+	}
+	return name, true
+}
+
+// ======================
+// 🔌 S3: Client
+// ======================
+
+// Attempts per S3 call, including the first. The SDK's standard retryer only
+// retries throttling, 5xx and network errors (never a 403), with jittered
+// exponential backoff.
+var s3MaxAttempts = 3
+
+// Per-operation S3 deadline (S3_TIMEOUT_MS), so a hung call fails with a 504
+// instead of running out the Lambda's own timeout.
+var s3Timeout = 5 * time.Second
+
+// Headroom left before the Lambda deadline to build and return a response.
+const lambdaDeadlineMargin = 500 * time.Millisecond
+
+var (
+	// Storage time budget for any action (ACTION_TIMEOUT_MS); 0 leaves only
+	// the per-call s3Timeout and the Lambda deadline
+	defaultActionTimeout time.Duration
+	// Per-action overrides from TIMEOUT_<ACTION>_MS, keyed by lower-cased
+	// action (TIMEOUT_GETBYID_MS → "getbyid")
+	actionTimeouts = map[string]time.Duration{}
+)
+
+func loadActionTimeouts() {
+	parse := func(name, v string) time.Duration {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("❌ %s must be a positive integer", name)
+		}
+		return time.Duration(n) * time.Millisecond
+	}
+
+	if v := os.Getenv("ACTION_TIMEOUT_MS"); v != "" {
+		defaultActionTimeout = parse("ACTION_TIMEOUT_MS", v)
+	}
+	for _, kv := range os.Environ() {
+		name, v, _ := strings.Cut(kv, "=")
+		action, ok := strings.CutPrefix(name, "TIMEOUT_")
+		if !ok || !strings.HasSuffix(action, "_MS") {
+			continue
+		}
+		actionTimeouts[strings.ToLower(strings.TrimSuffix(action, "_MS"))] = parse(name, v)
+	}
+}
+
+// withActionTimeout applies the action's budget to everything dispatch does
+// with storage. The deadline margin is added back so the budget is what S3
+// calls actually get (see withS3Timeout); running out surfaces as a 504.
+func withActionTimeout(ctx context.Context, action string) (context.Context, context.CancelFunc) {
+	timeout, ok := actionTimeouts[strings.ToLower(action)]
+	if !ok {
+		timeout = defaultActionTimeout
+	}
+	if timeout == 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout+lambdaDeadlineMargin)
+}
+
+// withS3Timeout bounds one S3 operation by s3Timeout, shortened further when
+// the invocation's own deadline is closer.
+func withS3Timeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := s3Timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = min(timeout, time.Until(deadline)-lambdaDeadlineMargin)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Region the bucket lives in (S3_BUCKET_REGION), when it differs from the
+// Lambda's; empty keeps the default resolution chain.
+var s3BucketRegion string
+
+// Custom S3 endpoint (AWS_ENDPOINT_URL) for LocalStack/MinIO; empty uses AWS.
+var s3EndpointURL string
+
+// Replica region reads fall back to when the primary fails
+// (S3_FAILOVER_REGION), and the replica bucket's name if it differs
+// (S3_FAILOVER_BUCKET); no region disables failover
+var (
+	s3FailoverRegion string
+	s3FailoverBucket string
+)
+
+// newS3Client builds the shared client; optFns adjust it further, e.g. the
+// failover client's region.
+func newS3Client(cfg aws.Config, optFns ...func(*s3.Options)) *s3.Client {
+	return s3.NewFromConfig(cfg, append([]func(*s3.Options){func(o *s3.Options) {
+		o.Retryer = retry.NewStandard(func(so *retry.StandardOptions) {
+			so.MaxAttempts = s3MaxAttempts
+		})
+		if s3BucketRegion != "" {
+			o.Region = s3BucketRegion
+		}
+		if s3EndpointURL != "" {
+			o.BaseEndpoint = aws.String(s3EndpointURL)
+			// LocalStack and MinIO don't resolve virtual-hosted bucket
+			// subdomains (bucket.localhost:4566), so address the bucket in
+			// the path instead: http://localhost:4566/bucket/key
+			o.UsePathStyle = true
+		}
+	}}, optFns...)...)
+}
+
+// ======================
+// 📤 S3: Get JSON
+// ======================
+
+// getS3JSON returns the stored messages plus the object's ETag and
+// modification time, which are zero when the file does not exist yet.
+func getS3JSON(ctx context.Context, s3Client *s3.Client, bucket, s3Key string) (AllMessages, ObjectMeta, error) {
+	logger := loggerFrom(ctx).With("bucket", bucket, "key", s3Key, "region", s3Client.Options().Region)
+	logger.Info("s3 get")
+
+	getInput := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(s3Key),
+	}
+
+	// A cached copy turns the read into a conditional GET; otherwise check
+	// existence first so a missing file reads as an empty array
+	cached, cachedMeta, hasCached := messageCache.Get(bucket + "/" + s3Key)
+	if hasCached {
+		getInput.IfNoneMatch = aws.String(cachedMeta.ETag)
+	} else {
+		_, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(s3Key),
+		})
+		if err != nil {
+			if isS3NotFoundErr(err) {
+				return []Message{}, ObjectMeta{}, nil // File not found → return empty array
+			}
+			logger.Error("s3 head failed", "error", err)
+			return nil, ObjectMeta{}, fmt.Errorf("head failed: %w", err)
+		}
+	}
+
+	resp, err := s3Client.GetObject(ctx, getInput)
+	if err != nil {
+		if hasCached && isS3NotModifiedErr(err) {
+			logger.Info("s3 get served from cache")
+			return cached, cachedMeta, nil
+		}
+		if hasCached && isS3NotFoundErr(err) {
+			messageCache.Remove(bucket + "/" + s3Key)
+			return []Message{}, ObjectMeta{}, nil
+		}
+		logger.Error("s3 get failed", "error", err)
+		return nil, ObjectMeta{}, fmt.Errorf("get failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var messages AllMessages
+	if err := decodeS3Body(ctx, s3Client, bucket, s3Key, resp, &messages); err != nil {
+		return nil, ObjectMeta{}, err
+	}
+
+	meta := ObjectMeta{
+		ETag:         aws.ToString(resp.ETag),
+		LastModified: aws.ToTime(resp.LastModified),
+	}
+	messageCache.Put(bucket+"/"+s3Key, messages, meta)
+	return messages, meta, nil
+}
+
+// decodeS3Body decompresses and decodes a GetObject body into v.
+func decodeS3Body(ctx context.Context, s3Client *s3.Client, bucket, s3Key string, resp *s3.GetObjectOutput, v interface{}) error {
+	body, err := decompressBody(resp.Body, aws.ToString(resp.ContentEncoding))
+	if err != nil {
+		return fmt.Errorf("decompress failed: %v", err)
+	}
+
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		return decodeError(ctx, s3Client, bucket, s3Key, err)
+	}
+
+	return nil
+}
+
+// decodeError turns JSON syntax/type errors into a CorruptFileError.
+func decodeError(ctx context.Context, s3Client *s3.Client, bucket, s3Key string, err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return corruptFile(ctx, s3Client, bucket, s3Key, syntaxErr.Offset, err)
+	case errors.As(err, &typeErr):
+		return corruptFile(ctx, s3Client, bucket, s3Key, typeErr.Offset, err)
+	}
+	return fmt.Errorf("decode failed: %v", err)
+}
+
+// ======================
+// 🌊 S3: Stream JSON
+// ======================
+
+// streamS3JSON decodes the stored array one element at a time and keeps only
+// the messages accepted by keep, so memory grows with the result rather than
+// the file. It bypasses the cache.
+func streamS3JSON(ctx context.Context, s3Client *s3.Client, bucket, s3Key string, keep func(Message) bool) (AllMessages, error) {
+	logger := loggerFrom(ctx).With("bucket", bucket, "key", s3Key)
+	logger.Info("s3 stream")
+
+	resp, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(s3Key),
+	})
+	if err != nil {
+		if isS3NotFoundErr(err) {
+			return AllMessages{}, nil
+		}
+		logger.Error("s3 get failed", "error", err)
+		return nil, fmt.Errorf("get failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := decompressBody(resp.Body, aws.ToString(resp.ContentEncoding))
+	if err != nil {
+		return nil, fmt.Errorf("decompress failed: %v", err)
+	}
+
+	dec := json.NewDecoder(body)
+	if tok, err := dec.Token(); err != nil {
+		return nil, decodeError(ctx, s3Client, bucket, s3Key, err)
+	} else if tok != json.Delim('[') {
+		err := &json.UnmarshalTypeError{Value: fmt.Sprint(tok), Type: reflect.TypeOf(AllMessages{}), Offset: dec.InputOffset()}
+		return nil, decodeError(ctx, s3Client, bucket, s3Key, err)
+	}
+
+	matches := AllMessages{}
+	for dec.More() {
+		var m Message
+		if err := dec.Decode(&m); err != nil {
+			return nil, decodeError(ctx, s3Client, bucket, s3Key, err)
+		}
+		if keep(m) {
+			matches = append(matches, m)
+		}
+	}
+	if _, err := dec.Token(); err != nil { // Closing ]
+		return nil, decodeError(ctx, s3Client, bucket, s3Key, err)
+	}
+
+	return matches, nil
+}
+
+// ======================
+// 🔚 S3: Tail JSON
+// ======================
+
+// tailS3JSON returns the last n messages accepted by keep, in file order.
+// It still decodes the whole object; the signature is shaped so a ranged GET
+// that reads only the end of the file can replace the body later.
+func tailS3JSON(ctx context.Context, s3Client *s3.Client, bucket, s3Key string, n int, keep func(Message) bool) (AllMessages, error) {
+	matches, err := streamS3JSON(ctx, s3Client, bucket, s3Key, keep)
+	if err != nil {
+		return nil, err
+	}
+	return lastMessages(matches, n), nil
+}
+
+// lastMessages returns the final n messages, or all of them when fewer.
+func lastMessages(messages AllMessages, n int) AllMessages {
+	if n < len(messages) {
+		return messages[len(messages)-n:]
+	}
+	return messages
+}
+
+// ======================
+// 🩹 S3: Corrupt Files
+// ======================
+
+// CorruptFileError means a stored object isn't a valid message array.
+type CorruptFileError struct {
+	Offset      int64 // Byte offset of the decode error
+	Quarantined bool  // Moved aside to <key>.corrupt
+	Err         error
+}
+
+func (e *CorruptFileError) Error() string {
+	return fmt.Sprintf("corrupt file at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *CorruptFileError) Unwrap() error { return e.Err }
+
+// Opt-in: move corrupt objects aside so the next write starts a fresh file
+var quarantineCorrupt bool
+
+func corruptFile(ctx context.Context, s3Client *s3.Client, bucket, s3Key string, offset int64, decodeErr error) error {
+	logger := loggerFrom(ctx).With("bucket", bucket, "key", s3Key)
+	logger.Error("stored file is corrupt", "offset", offset, "error", decodeErr)
+
+	corruptErr := &CorruptFileError{Offset: offset, Err: decodeErr}
+	if !quarantineCorrupt {
+		return corruptErr
+	}
+
+	quarantineKey := s3Key + ".corrupt"
+	_, err := s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(quarantineKey),
+		CopySource: aws.String(url.PathEscape(bucket + "/" + s3Key)),
+	})
+	if err != nil {
+		logger.Error("quarantine copy failed", "error", err)
+		return corruptErr
+	}
+
+	_, err = s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(s3Key),
+	})
+	if err != nil {
+		logger.Error("quarantine delete failed", "error", err)
+		return corruptErr
+	}
+
+	messageCache.Remove(bucket + "/" + s3Key)
+	logger.Info("corrupt file quarantined", "quarantineKey", quarantineKey)
+	corruptErr.Quarantined = true
+	return corruptErr
+}
+
+// ======================
+// 📥 S3: Save JSON
+// ======================
+
+var (
+	// ErrPreconditionFailed means the object changed since it was read.
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrFileTooLarge means the marshaled file exceeds maxFileBytes.
+	ErrFileTooLarge = errors.New("file too large")
+	// ErrFileNotFound means there is no file to delete, copy or rename.
+	ErrFileNotFound = errors.New("file not found")
+	// ErrFileExists means a copy would overwrite an existing file.
+	ErrFileExists = errors.New("file already exists")
+	// ErrStorageTimeout means a storage call ran past its deadline.
+	ErrStorageTimeout = errors.New("storage timeout")
+)
+
+// Upper bound on a stored file's uncompressed JSON size (MAX_FILE_BYTES)
+var maxFileBytes = 10 << 20
+
+// Upper bound on elements per file, tombstones included (MAX_MESSAGES); 0
+// means unlimited
+var maxMessages = 0
+
+// Share of maxMessages at which responses start warning
+// (MAX_MESSAGES_WARN_PERCENT)
+var maxMessagesWarnPercent = 80
+
+type warningsKey struct{}
+
+// withWarnings gives the request somewhere to collect warnings while it runs.
+func withWarnings(ctx context.Context) context.Context {
+	return context.WithValue(ctx, warningsKey{}, &[]string{})
+}
+
+func addWarning(ctx context.Context, warning string) {
+	warnings, ok := ctx.Value(warningsKey{}).(*[]string)
+	if !ok || slices.Contains(*warnings, warning) {
+		return
+	}
+	*warnings = append(*warnings, warning)
+}
+
+// noteMessageCount warns once a file the request touched holds n messages,
+// at or past the warning share of maxMessages.
+func noteMessageCount(ctx context.Context, n int) {
+	if maxMessages > 0 && n*100 >= maxMessages*maxMessagesWarnPercent {
+		addWarning(ctx, fmt.Sprintf("file approaching size limit: %d of %d messages, consider archiving", n, maxMessages))
+	}
+}
+
+// countingScan wraps a Scan/Tail filter to count every message it sees, so
+// streaming reads can call noteMessageCount like the ones that load the file.
+func countingScan(n *int, keep func(Message) bool) func(Message) bool {
+	return func(m Message) bool {
+		*n++
+		return keep(m)
+	}
+}
+
+// attachWarnings adds collected warnings to a successful response: in the
+// envelope's warnings when there is one, otherwise as Warning headers.
+func attachWarnings(ctx context.Context, status int, payload interface{}) interface{} {
+	warnings, _ := ctx.Value(warningsKey{}).(*[]string)
+	if warnings == nil || len(*warnings) == 0 || status >= 400 {
+		return payload
+	}
+
+	switch p := payload.(type) {
+	case APIResponse:
+		p.Warnings = append(p.Warnings, *warnings...)
+		return p
+	case *httpPayload:
+		if resp, ok := p.JSON.(APIResponse); ok {
+			resp.Warnings = append(resp.Warnings, *warnings...)
+			p.JSON = resp
+			return p
+		}
+		if p.Headers == nil {
+			p.Headers = map[string]string{}
+		}
+		p.Headers["Warning"] = warningHeader(*warnings)
+		return p
+	default:
+		return &httpPayload{Headers: map[string]string{"Warning": warningHeader(*warnings)}, JSON: payload}
+	}
+}
+
+// warningHeader formats RFC 7234 Warning values (code 199, miscellaneous).
+func warningHeader(warnings []string) string {
+	values := make([]string, len(warnings))
+	for i, w := range warnings {
+		values[i] = fmt.Sprintf("199 - %q", w)
+	}
+	return strings.Join(values, ", ")
+}
+
+// checkCapacity fails with errFileFull when adding n elements would take the
+// file past maxMessages.
+func checkCapacity(messages AllMessages, n int) error {
+	if maxMessages > 0 && len(messages)+n > maxMessages {
+		return fmt.Errorf("%w (%d + %d > %d messages)", errFileFull, len(messages), n, maxMessages)
+	}
+	return nil
+}
+
+// Indent stored JSON for humans (JSON_PRETTY, default true); false writes
+// compact JSON. Readers accept either.
+var jsonPretty = true
+
+// putS3JSON writes v (messages or generic records). When etag is set the
+// write only succeeds if the object still has that ETag (optimistic
+// concurrency); versionAbsent instead only succeeds if there is no object.
+func putS3JSON(ctx context.Context, s3Client *s3.Client, bucket, s3Key string, v interface{}, etag string) error {
+	logger := loggerFrom(ctx).With("bucket", bucket, "key", s3Key)
+	logger.Info("s3 put", "ifMatch", etag)
+
+	var data []byte
+	var err error
+	if jsonPretty {
+		data, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		data, err = json.Marshal(v)
+	}
+	if err != nil {
+		return fmt.Errorf("marshal failed: %v", err)
+	}
+	if len(data) > maxFileBytes {
+		logger.Info("s3 put rejected: file too large", "bytes", len(data), "limit", maxFileBytes)
+		return fmt.Errorf("put failed: %w (%d > %d bytes)", ErrFileTooLarge, len(data), maxFileBytes)
+	}
+
+	data, err = gzipBytes(data)
+	if err != nil {
+		return fmt.Errorf("compress failed: %v", err)
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(s3Key),
+		Body:            bytes.NewReader(data),
+		ContentType:     aws.String("application/json"),
+		ContentEncoding: aws.String("gzip"),
+	}
+	if s3CacheControl != "" {
+		input.CacheControl = aws.String(s3CacheControl)
+	}
+	applyServerSideEncryption(input)
+	applyObjectTags(ctx, input)
+	if etag == versionAbsent {
+		input.IfNoneMatch = aws.String("*")
+	} else if etag != "" {
+		input.IfMatch = aws.String(etag)
+	}
+
+	// Drop the cached copy whatever the outcome; the next read refetches
+	messageCache.Remove(bucket + "/" + s3Key)
+
+	if stagedWrites {
+		return stagedPut(ctx, s3Client, input, etag)
+	}
+
+	_, err = s3Client.PutObject(ctx, input)
+	if err != nil {
+		if isS3PreconditionErr(err) {
+			logger.Info("s3 put precondition failed")
+			return fmt.Errorf("put failed: %w", ErrPreconditionFailed)
+		}
+		logger.Error("s3 put failed", "error", err)
+		return fmt.Errorf("put failed: %v", err)
+	}
+
+	return nil
+}
+
+// S3_STAGED_WRITES=true uploads to a temporary key and copies it over the
+// file, trading two extra requests for never exposing a partial upload.
+var stagedWrites bool
+
+// stagedPut writes input to "<key>.tmp.<uuid>", then copies that over the
+// real key and removes it, success or not. CopyObject can't be made
+// conditional on the destination, so etag is checked with a HEAD first: a
+// narrower race than none, not an atomic guarantee.
+func stagedPut(ctx context.Context, s3Client *s3.Client, input *s3.PutObjectInput, etag string) error {
+	bucket, s3Key := aws.ToString(input.Bucket), aws.ToString(input.Key)
+	tmpKey := s3Key + ".tmp." + uuid.NewString()
+	logger := loggerFrom(ctx).With("bucket", bucket, "key", s3Key, "tmpKey", tmpKey)
+
+	current, err := headS3Object(ctx, s3Client, bucket, s3Key)
+	if err != nil {
+		return fmt.Errorf("put failed: %v", err)
+	}
+	if (etag == versionAbsent && current.ETag != "") || (etag != "" && etag != versionAbsent && etag != current.ETag) {
+		logger.Info("s3 put precondition failed")
+		return fmt.Errorf("put failed: %w", ErrPreconditionFailed)
+	}
+
+	staged := *input
+	staged.Key = aws.String(tmpKey)
+	staged.IfMatch, staged.IfNoneMatch = nil, nil
+	defer func() {
+		// Detached so a timed-out request still cleans up after itself
+		_, err := s3Client.DeleteObject(context.WithoutCancel(ctx), &s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(tmpKey),
+		})
+		if err != nil {
+			logger.Error("s3 temp object cleanup failed", "error", err)
+		}
+	}()
+
+	resp, err := s3Client.PutObject(ctx, &staged)
+	if err != nil {
+		logger.Error("s3 staged put failed", "error", err)
+		return fmt.Errorf("put failed: %v", err)
+	}
+
+	// The default COPY directive keeps Content-Encoding and Cache-Control
+	copyInput := &s3.CopyObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(s3Key),
+		CopySource:        aws.String(url.PathEscape(bucket + "/" + tmpKey)),
+		CopySourceIfMatch: resp.ETag,
+	}
+	applyCopyServerSideEncryption(copyInput)
+	if _, err := s3Client.CopyObject(ctx, copyInput); err != nil {
+		logger.Error("s3 staged copy failed", "error", err)
+		return fmt.Errorf("put failed: %v", err)
+	}
+	return nil
+}
+
+// ======================
+// 🔒 S3: Encryption
+// ======================
+
+var (
+	s3SSE      string // "", "AES256" or "aws:kms" (S3_SSE)
+	s3KMSKeyID string // Only used with aws:kms (S3_KMS_KEY_ID)
+)
+
+// applyServerSideEncryption requests SSE on a write; unset keeps the bucket
+// default.
+func applyServerSideEncryption(input *s3.PutObjectInput) {
+	if s3SSE == "" {
+		return
+	}
+	input.ServerSideEncryption = types.ServerSideEncryption(s3SSE)
+	if s3SSE == string(types.ServerSideEncryptionAwsKms) && s3KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(s3KMSKeyID)
+	}
+}
+
+// applyCopyServerSideEncryption is applyServerSideEncryption for copies,
+// which don't inherit the source object's encryption settings.
+func applyCopyServerSideEncryption(input *s3.CopyObjectInput) {
+	if s3SSE == "" {
+		return
+	}
+	input.ServerSideEncryption = types.ServerSideEncryption(s3SSE)
+	if s3SSE == string(types.ServerSideEncryptionAwsKms) && s3KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(s3KMSKeyID)
+	}
+}
+
+// ======================
+// 🏷️ S3: Tagging
+// ======================
+
+// Tag key set to the authenticated subject on every write (TAG_SUBJECT_KEY),
+// e.g. "tenant" for per-tenant lifecycle rules and cost reports
+var tagSubjectKey string
+
+// S3 limits: https://docs.aws.amazon.com/AmazonS3/latest/userguide/object-tagging.html
+const (
+	maxObjectTags     = 10
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+)
+
+var tagCharsPattern = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+var tagDisallowedChars = regexp.MustCompile(`[^\p{L}\p{Z}\p{N}_.:/=+\-@]`)
+
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxObjectTags {
+		return fmt.Errorf("at most %d tags allowed", maxObjectTags)
+	}
+	for k, v := range tags {
+		switch {
+		case k == "" || utf8.RuneCountInString(k) > maxTagKeyLength:
+			return fmt.Errorf("tag key %q must be 1-%d characters", k, maxTagKeyLength)
+		case strings.HasPrefix(strings.ToLower(k), "aws:"):
+			return fmt.Errorf("tag key %q uses the reserved aws: prefix", k)
+		case utf8.RuneCountInString(v) > maxTagValueLength:
+			return fmt.Errorf("tag %q value longer than %d characters", k, maxTagValueLength)
+		case !tagCharsPattern.MatchString(k) || !tagCharsPattern.MatchString(v):
+			return fmt.Errorf("tag %q may only use letters, digits, spaces and _ . : / = + - @", k)
+		}
+	}
+	return nil
+}
+
+type tagsKey struct{}
+
+// withObjectTags sets the tags every object written by this request gets.
+func withObjectTags(ctx context.Context, tags map[string]string) context.Context {
+	return context.WithValue(ctx, tagsKey{}, tags)
+}
+
+// applyObjectTags tags a write; no tags leaves the object untagged.
+func applyObjectTags(ctx context.Context, input *s3.PutObjectInput) {
+	tags, _ := ctx.Value(tagsKey{}).(map[string]string)
+	if len(tags) == 0 {
+		return
+	}
+	values := url.Values{}
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+	// Spaces as %20: S3 doesn't read "+" as a space in tag sets. Literal "+"
+	// is already escaped as %2B.
+	input.Tagging = aws.String(strings.ReplaceAll(values.Encode(), "+", "%20"))
+}
+
+// requestTags merges the request's tags with the subject tag, which wins so
+// a caller can't file objects under another tenant.
+func requestTags(ctx context.Context, requested map[string]string) (map[string]string, error) {
+	if err := validateTags(requested); err != nil {
+		return nil, err
+	}
+	tags := maps.Clone(requested)
+	if sub := subjectFrom(ctx); tagSubjectKey != "" && sub != "" {
+		if tags == nil {
+			tags = map[string]string{}
+		}
+		tags[tagSubjectKey] = subjectTagValue(ctx, sub)
+		if len(tags) > maxObjectTags {
+			return nil, fmt.Errorf("at most %d tags allowed besides %q", maxObjectTags-1, tagSubjectKey)
+		}
+	}
+	return tags, nil
+}
+
+// subjectTagValue fits a JWT subject into S3's tag value rules. Subjects
+// like "auth0|abc" are the caller's identity, not their input, so rather
+// than rejecting the request the disallowed characters become "_" and the
+// value is cut to length.
+func subjectTagValue(ctx context.Context, sub string) string {
+	value := []rune(tagDisallowedChars.ReplaceAllString(sub, "_"))
+	if len(value) > maxTagValueLength {
+		value = value[:maxTagValueLength]
+	}
+	if string(value) != sub {
+		loggerFrom(ctx).Warn("subject sanitized for tagging", "subject", sub, "tag", string(value))
+	}
+	return string(value)
+}
+
+// ======================
+// 🗜️ Gzip
+// ======================
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressBody unwraps gzip content. Objects written before compression was
+// added have no Content-Encoding, so the gzip magic bytes are checked too.
+func decompressBody(r io.Reader, contentEncoding string) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if contentEncoding != "gzip" {
+		magic, err := br.Peek(2)
+		if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+			return br, nil
+		}
+	}
+	return gzip.NewReader(br)
+}
+
+// ======================
+// 🔎 S3: Head Object
+// ======================
+
+// headS3Object returns an object's metadata without its body; zero when the
+// object doesn't exist.
+func headS3Object(ctx context.Context, s3Client *s3.Client, bucket, s3Key string) (ObjectMeta, error) {
+	resp, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(s3Key),
+	})
+	if err != nil {
+		if isS3NotFoundErr(err) {
+			return ObjectMeta{}, nil
+		}
+		loggerFrom(ctx).Error("s3 head failed", "bucket", bucket, "key", s3Key, "error", err)
+		return ObjectMeta{}, fmt.Errorf("head failed: %v", err)
+	}
+
+	return ObjectMeta{
+		ETag:         aws.ToString(resp.ETag),
+		LastModified: aws.ToTime(resp.LastModified),
+	}, nil
+}
+
+// ======================
+// 🩺 S3: Head Bucket
+// ======================
+
+// headS3Bucket checks the bucket is reachable without reading any object.
+func headS3Bucket(ctx context.Context, s3Client *s3.Client, bucket string) error {
+	_, err := s3Client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(bucket),
+	})
+	if err != nil {
+		loggerFrom(ctx).Error("s3 head bucket failed", "bucket", bucket, "error", err)
+		return fmt.Errorf("head bucket failed: %v", err)
+	}
+	return nil
+}
+
+// ======================
+// 📃 S3: List Keys
+// ======================
+
+func listS3Keys(ctx context.Context, s3Client *s3.Client, bucket, prefix string) ([]ObjectInfo, error) {
+	logger := loggerFrom(ctx).With("bucket", bucket, "prefix", prefix)
+	logger.Info("s3 list")
+
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	objects := []ObjectInfo{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			logger.Error("s3 list failed", "error", err)
+			return nil, fmt.Errorf("list failed: %v", err)
+		}
+		for _, obj := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.ToString(obj.Key),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+
+	return objects, nil
+}
+
+// ======================
+// 🗑️ S3: Delete Object
+// ======================
+
+// deleteS3Object removes a file. S3's DeleteObject succeeds on missing keys,
+// so a HEAD first tells the caller whether there was anything to delete.
+func deleteS3Object(ctx context.Context, s3Client *s3.Client, bucket, s3Key string) error {
+	logger := loggerFrom(ctx).With("bucket", bucket, "key", s3Key)
+
+	meta, err := headS3Object(ctx, s3Client, bucket, s3Key)
+	if err != nil {
+		return err
+	}
+	if meta.ETag == "" {
+		return ErrFileNotFound
+	}
+
+	logger.Info("s3 delete")
+	_, err = s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(s3Key),
+	})
+	messageCache.Remove(bucket + "/" + s3Key)
+	if err != nil {
+		logger.Error("s3 delete failed", "error", err)
+		return fmt.Errorf("delete failed: %v", err)
+	}
+	return nil
+}
+
+// ======================
+// 🔗 S3: Presign
+// ======================
+
+// How long presigned URLs stay valid (PRESIGN_TTL); SigV4 caps it at 7 days
+var presignTTL = 15 * time.Minute
+
+// presignS3Get returns a URL that downloads s3Key without credentials until
+// it expires. Files are stored gzipped; the Content-Encoding header lets
+// HTTP clients decompress transparently.
+func presignS3Get(ctx context.Context, s3Client *s3.Client, bucket, s3Key string, ttl time.Duration) (string, error) {
+	req, err := s3.NewPresignClient(s3Client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(s3Key),
+	}, s3.WithPresignExpires(ttl))
+	if err != nil {
+		loggerFrom(ctx).Error("s3 presign failed", "bucket", bucket, "key", s3Key, "error", err)
+		return "", fmt.Errorf("presign failed: %v", err)
+	}
+	return req.URL, nil
+}
+
+// Large imports are uploaded here first (presignUpload), outside dataPrefix
+// so a half-uploaded file is never listed or read as messages
+const stagingPrefix = "staging/"
+
+var stagingKeyPattern = regexp.MustCompile(`^[0-9a-f-]{36}\.(json|csv)$`)
+
+// validStagingKey accepts only keys presignUpload could have issued to owner.
+func validStagingKey(key, owner string) bool {
+	prefix := stagingPrefix + ownerPrefix(owner)
+	return strings.HasPrefix(key, prefix) && stagingKeyPattern.MatchString(strings.TrimPrefix(key, prefix))
+}
+
+// presignUploadResponse issues a PUT URL for a new staging key. The content
+// type is signed, so the upload must send the same Content-Type.
+func presignUploadResponse(ctx context.Context, owner, format string) (int, interface{}) {
+	var ext, contentType string
+	switch format {
+	case "", "json":
+		ext, contentType = "json", "application/json"
+	case "csv":
+		ext, contentType = "csv", "text/csv"
+	default:
+		return clientError(400, "format must be csv or json")
+	}
+
+	key := stagingPrefix + ownerPrefix(owner) + uuid.NewString() + "." + ext
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucketFrom(ctx)),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	}
+	applyServerSideEncryption(input)
+
+	expiresAt := time.Now().UTC().Add(presignTTL)
+	req, err := s3.NewPresignClient(s3Client).PresignPutObject(ctx, input, s3.WithPresignExpires(presignTTL))
+	if err != nil {
+		loggerFrom(ctx).Error("s3 presign failed", "key", key, "error", err)
+		return clientError(500, fmt.Sprintf("presign failed: %v", err))
+	}
+	return successResponse(APIResponse{Status: "ok", Data: map[string]string{
+		"url":         req.URL,
+		"method":      req.Method,
+		"stagingKey":  key,
+		"contentType": contentType,
+		"expiresAt":   expiresAt.Format(time.RFC3339),
+	}})
+}
+
+// readStagedUpload reads an uploaded import file, refusing anything larger
+// than maxFileBytes since the upload itself had no size limit.
+func readStagedUpload(ctx context.Context, s3Client *s3.Client, bucket, key string) ([]byte, error) {
+	resp, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isS3NotFoundErr(err) {
+			return nil, ErrFileNotFound
+		}
+		loggerFrom(ctx).Error("s3 get failed", "bucket", bucket, "key", key, "error", err)
+		return nil, fmt.Errorf("get failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxFileBytes)+1))
+	if err != nil {
+		return nil, fmt.Errorf("read failed: %v", err)
+	}
+	if len(data) > maxFileBytes {
+		return nil, ErrFileTooLarge
+	}
+	return data, nil
+}
+
+// ======================
+// 📑 S3: Copy Object
+// ======================
+
+// copyS3Object copies srcKey to dstKey server-side. Without overwrite an
+// existing destination fails with ErrFileExists; CopyObject has no
+// destination precondition, so this is a HEAD check rather than atomic.
+func copyS3Object(ctx context.Context, s3Client *s3.Client, bucket, srcKey, dstKey string, overwrite bool) error {
+	logger := loggerFrom(ctx).With("bucket", bucket, "key", srcKey, "destination", dstKey)
+
+	src, err := headS3Object(ctx, s3Client, bucket, srcKey)
+	if err != nil {
+		return err
+	}
+	if src.ETag == "" {
+		return ErrFileNotFound
+	}
+	if !overwrite {
+		dst, err := headS3Object(ctx, s3Client, bucket, dstKey)
+		if err != nil {
+			return err
+		}
+		if dst.ETag != "" {
+			return ErrFileExists
+		}
+	}
+
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(dstKey),
+		CopySource: aws.String(url.PathEscape(bucket + "/" + srcKey)),
+		// Copy exactly the version we checked; a concurrent write fails it
+		CopySourceIfMatch: aws.String(src.ETag),
+	}
+	applyCopyServerSideEncryption(input)
+
+	logger.Info("s3 copy")
+	_, err = s3Client.CopyObject(ctx, input)
+	messageCache.Remove(bucket + "/" + dstKey)
+	if err != nil {
+		if isS3PreconditionErr(err) {
+			return ErrPreconditionFailed
+		}
+		logger.Error("s3 copy failed", "error", err)
+		return fmt.Errorf("copy failed: %v", err)
+	}
+	return nil
+}
+
+// ======================
+// ❓ S3: Is Not Found?
+// ======================
+
+func isS3NotFoundErr(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return true
+	}
+
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return true
+	}
+
+	// HeadObject has no body, so S3 often only reports a generic "NotFound" code
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NotFound", "NoSuchKey":
+			return true
+		}
+	}
+
+	return false
+}
+
+// ======================
+// ❓ S3: Precondition Failed?
+// ======================
+
+func isS3PreconditionErr(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return true
+		}
+	}
+	return false
+}
+
+// ======================
+// ❓ S3: Not Modified?
+// ======================
+
+func isS3NotModifiedErr(err error) bool {
+	var respErr *smithyhttp.ResponseError
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == 304
+}
+
+// ======================
+// 🧩 Gin Handlers (Normal Mode)
+// ======================
+
+func setupGinHandlers() *gin.Engine {
+	r := gin.Default()
+	r.Use(corsMiddleware())
+	r.Use(rateLimitMiddleware(rateLimitRPS, rateLimitBurst))
+
+	r.GET("/", func(c *gin.Context) {
+		c.JSON(200, gin.H{"message": "Gin + Lambda + S3 CRUD API"})
+	})
+	r.GET("/test", func(c *gin.Context) {
+		c.JSON(200, gin.H{"message": "Test Success"})
+	})
+	r.GET("/healthz", func(c *gin.Context) {
+		status, payload := healthResponse(c.Request.Context())
+		writeGinResponse(c, status, payload)
+	})
+	if err := registerPrometheus(); err != nil {
+		log.Printf("⚠️ Prometheus metrics disabled: %v", err)
+	} else {
+		r.GET("/metrics", metricsHandler())
+	}
+
+	// CRUD routes map the HTTP verb to an action and run the same dispatch as
+	// Lambda, e.g. POST /messages?filename=file1 → add
+	messages := r.Group("/messages", ginGuard())
+	messages.GET("", ginAction("get"))
+	messages.POST("", ginAction("add"))
+	messages.PUT("/:id", ginAction("update"))
+	messages.DELETE("/:id", ginAction("delete"))
+
+	return r
+}
+
+// ginGuard runs Handler's checks before a request is parsed: body size,
+// Content-Type and auth. The permission check needs the action, so ginAction
+// makes it.
+func ginGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tooLarge := func() {
+			writeGinResponse(c, 413, map[string]string{"error": fmt.Sprintf("Request body exceeds %d bytes", maxBodyBytes)})
+			c.Abort()
+		}
+		if c.Request.ContentLength > int64(maxBodyBytes) {
+			tooLarge()
+			return
+		}
+		// Chunked bodies have no length up front; ginAction reports the overrun
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(maxBodyBytes))
+
+		headers := map[string]string{}
+		for name := range c.Request.Header {
+			headers[name] = c.Request.Header.Get(name)
+		}
+
+		ctx, err := withCaller(c.Request.Context(), headers)
+		if err != nil {
+			loggerFrom(ctx).Info("unauthorized", "error", err)
+			writeGinResponse(c, 401, map[string]string{"error": fmt.Sprintf("Unauthorized: %v", err)})
+			c.Abort()
+			return
+		}
+		c.Request = c.Request.WithContext(ctx)
+
+		if checkContentType && c.Request.ContentLength != 0 && !acceptedContentType(c.GetHeader("Content-Type")) {
+			loggerFrom(ctx).Info("unsupported content type", "contentType", c.GetHeader("Content-Type"))
+			writeGinResponse(c, 415, map[string]string{"error": "unsupported media type"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// ginAction serves a REST route as the given action. The APIRequest is built
+// from the JSON body (any field), then the query string, path and headers,
+// matching what Handler reads from API Gateway.
+func ginAction(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		if status, payload, ok := checkAllowed(ctx, action); !ok {
+			writeGinResponse(c, status, payload)
+			return
+		}
+
+		var input APIRequest
+		if c.Request.ContentLength != 0 && c.Request.Method != "GET" {
+			if err := c.ShouldBindJSON(&input); err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					writeGinResponse(c, 413, map[string]string{"error": fmt.Sprintf("Request body exceeds %d bytes", maxBodyBytes)})
+					return
+				}
+				c.JSON(400, gin.H{"error": "Invalid JSON body"})
+				return
+			}
+		}
+
+		input.Action = action
+		input.Filename = firstNonEmpty(input.Filename, c.Query("filename"))
+		if id := c.Param("id"); id != "" {
+			n, err := strconv.Atoi(id)
+			switch {
+			case err == nil:
+				input.ID = n
+			case idStrategy == "uuid":
+				input.UUID = id
+			default:
+				c.JSON(400, gin.H{"error": "Invalid message id"})
+				return
+			}
+		}
+		input.IdempotencyKey = firstNonEmpty(input.IdempotencyKey, c.GetHeader("Idempotency-Key"))
+		input.IfModifiedSince = firstNonEmpty(input.IfModifiedSince, c.GetHeader("If-Modified-Since"))
+		input.IfNoneMatch = firstNonEmpty(input.IfNoneMatch, c.GetHeader("If-None-Match"))
+		input.Version = firstNonEmpty(input.Version, c.GetHeader("Accept-Version"))
+
+		// GET options travel in the query string, e.g. ?limit=20&fields=sender,message
+		input.Sender = firstNonEmpty(input.Sender, c.Query("sender"))
+		input.Receiver = firstNonEmpty(input.Receiver, c.Query("receiver"))
+		input.SortBy = firstNonEmpty(input.SortBy, c.Query("sortBy"))
+		input.SortDir = firstNonEmpty(input.SortDir, c.Query("sortDir"))
+		input.From = firstNonEmpty(input.From, c.Query("from"))
+		input.To = firstNonEmpty(input.To, c.Query("to"))
+		if v, err := strconv.Atoi(c.Query("limit")); err == nil {
+			input.Limit = v
+		}
+		if v, err := strconv.Atoi(c.Query("offset")); err == nil {
+			input.Offset = v
+		}
+		if v, err := strconv.Atoi(c.Query("afterId")); err == nil {
+			input.AfterID = v
+		}
+		input.AfterUUID = firstNonEmpty(input.AfterUUID, c.Query("afterUuid"))
+		if f := c.Query("fields"); f != "" {
+			input.Fields = strings.Split(f, ",")
+		}
+
+		status, payload := dispatch(ctx, input)
+		writeGinResponse(c, status, payload)
+	}
+}
+
+// writeGinResponse writes a dispatch result with the same headers and body
+// Lambda would send.
+func writeGinResponse(c *gin.Context, status int, payload interface{}) {
+	headers, body := encodePayload(payload)
+	for k, v := range headers {
+		c.Header(k, v)
+	}
+	c.Data(status, headers["Content-Type"], body)
+}
+
+// ======================
+// 🧠 Lambda Handler (API Gateway Proxy)
+// ======================
+
+type APIRequest struct {
+	Action   string `json:"action"`           // "get", "getById", "thread", "tail", "distinct", "count", "search", "export", "presign", "presignUpload", "add", "addMany", "import", "replace", "createFile", "upsert", "update", "updateWhere", "patch", "delete", "deleteMany", "deleteFile", "rename", "archive", "list", "health"
+	Filename string `json:"filename"`         // → file1.json
+	Bucket   string `json:"bucket,omitempty"` // Must be in ALLOWED_BUCKETS; default S3_BUCKET_NAME
+	// With PARTITION_BY_DATE: the day (YYYY-MM-DD) an action other than get/add works on
+	Partition string `json:"partition,omitempty"`
+	Version   string `json:"version,omitempty"` // Response shape version (Accept-Version); default currentAPIVersion
+	// For LIST:
+	Prefix    string `json:"prefix,omitempty"`    // Only list filenames starting with this
+	NamesOnly bool   `json:"namesOnly,omitempty"` // Plain filenames instead of {filename, size, lastModified}
+	// For ADD (and GET/COUNT filters, empty = any):
+	Sender   string `json:"sender,omitempty"`
+	Receiver string `json:"receiver,omitempty"`
+	Message  string `json:"message,omitempty"` // Query for SEARCH
+	Date     string `json:"date,omitempty"`
+	// For ADD: retries with the same key return the original message
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// For ADD: return the last message instead if it's the same one resent
+	// within DEDUP_WINDOW (by date)
+	DedupOnAdd bool `json:"dedupOnAdd,omitempty"`
+	// For ADD: reply to this existing message
+	ParentID   int    `json:"parentId,omitempty"`
+	ParentUUID string `json:"parentUuid,omitempty"` // Alternative to parentId with ID_STRATEGY=uuid
+	// For ADDMANY / REPLACE / CREATEFILE (optional initial messages):
+	Messages []Message `json:"messages,omitempty"`
+	// For RECORD_MODE=generic add/update:
+	Record Record `json:"record,omitempty"`
+	// For mutating actions: compute the result but skip the write
+	DryRun bool `json:"dryRun,omitempty"`
+	// For writes: S3 object tags (see TAG_SUBJECT_KEY for the tenant tag)
+	Tags map[string]string `json:"tags,omitempty"`
+	// For DELETEMANY: messages to tombstone in a single write
+	IDs   []int    `json:"ids,omitempty"`
+	UUIDs []string `json:"uuids,omitempty"` // Alternative to ids with ID_STRATEGY=uuid
+	// For DELETEFILE: must be true, guards against accidental wipes
+	Confirm bool `json:"confirm,omitempty"`
+	// For PATCH / UPDATEWHERE: RFC 7386 merge patch, e.g. {"parentId": null} clears it
+	Patch json.RawMessage `json:"patch,omitempty"`
+	// For UPDATEWHERE: patch every message, since sender/receiver filters are otherwise required
+	All bool `json:"all,omitempty"`
+	// For ARCHIVE: messages dated before this (RFC3339 or YYYY-MM-DD) move out
+	Before string `json:"before,omitempty"`
+	// For RENAME: destination name; an existing one fails unless overwrite
+	NewFilename string `json:"newFilename,omitempty"`
+	Overwrite   bool   `json:"overwrite,omitempty"`
+	// For GETBYID / THREAD / UPSERT / UPDATE / DELETE: you can add "id" or "index"
+	ID   int    `json:"id,omitempty"`   // Used to update/delete specific item
+	UUID string `json:"uuid,omitempty"` // Alternative to id with ID_STRATEGY=uuid
+	// For EXPORT / IMPORT:
+	Format  string `json:"format,omitempty"`  // "json" (default), "csv" or "ndjson" (export only)
+	Content string `json:"content,omitempty"` // IMPORT: base64-encoded file
+	// IMPORT: read the file from a presignUpload staging key instead of content
+	StagingKey string `json:"stagingKey,omitempty"`
+	Mode       string `json:"mode,omitempty"` // IMPORT: "append" or "replace"
+	// For GET:
+	IncludeDeleted  bool   `json:"includeDeleted,omitempty"`  // Also return tombstoned messages
+	IfModifiedSince string `json:"ifModifiedSince,omitempty"` // RFC3339; unchanged file → 304
+	IfNoneMatch     string `json:"ifNoneMatch,omitempty"`     // ETag from an earlier get; same response → 304
+	// For GET pagination (and TAIL size, default 50):
+	Limit  int `json:"limit,omitempty"`  // 0 → return everything
+	Offset int `json:"offset,omitempty"` // Clamped to the number of messages
+	// For GET sorting:
+	SortBy  string `json:"sortBy,omitempty"`  // "id" (default), "date", "sender", "createdAt"
+	SortDir string `json:"sortDir,omitempty"` // "asc" (default), "desc"
+	// For GET cursor pagination (ID order): pass the previous nextCursor
+	AfterID int `json:"afterId,omitempty"`
+	// With ID_STRATEGY=uuid the cursor is a UUID, passed back here instead
+	AfterUUID string `json:"afterUuid,omitempty"`
+	// For GET date range, inclusive (RFC3339 or YYYY-MM-DD, a whole day for To)
+	From           string `json:"from,omitempty"`
+	To             string `json:"to,omitempty"`
+	IncludeUndated bool   `json:"includeUndated,omitempty"` // Keep messages whose date won't parse
+	// For reads: string fields to return as "[redacted]"; stored data is untouched
+	Redact []string `json:"redact,omitempty"`
+	// For GET projection: return only these message fields ("id" always)
+	Fields []string `json:"fields,omitempty"`
+	// For DISTINCT: "sender" or "receiver"
+	Field string `json:"field,omitempty"`
+}
+
+// FileInfo is one entry of the list action.
+type FileInfo struct {
+	Filename     string `json:"filename"`
+	Size         int64  `json:"size"`         // Stored bytes
+	LastModified string `json:"lastModified"` // RFC3339
+}
+
+type APIResponse struct {
+	Status  string      `json:"status,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+	Message string      `json:"message,omitempty"`
+	Total   int         `json:"total,omitempty"`
+	DryRun  bool        `json:"dryRun,omitempty"` // Nothing was written
+	// Object version info for client-side caching (get)
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"` // RFC3339
+	// Cursor pagination (get): pass back as afterId (afterUuid with
+	// ID_STRATEGY=uuid); empty at the end
+	NextCursor string `json:"nextCursor,omitempty"`
+	// get: false when the file was never created (or was deleted), true when
+	// it's stored, even with no messages left
+	Exists *bool `json:"exists,omitempty"`
+	// Non-fatal notices, e.g. the file nearing MAX_MESSAGES
+	Warnings []string `json:"warnings,omitempty"`
+	// Envelope shape version; set by encodePayload
+	APIVersion string `json:"apiVersion,omitempty"`
+}
+
+// Response shape versions the API can produce; requests may pin one with
+// Accept-Version or "version", and get currentAPIVersion otherwise.
+const currentAPIVersion = "1"
+
+var supportedAPIVersions = map[string]bool{"1": true}
+
+// Largest request body Handler will parse (MAX_BODY_BYTES); defaults to the
+// 6 MB synchronous Lambda payload limit.
+var maxBodyBytes = 6 << 20
+
+// requestBodySize is the decoded body length; base64 bodies are measured by
+// what they decode to, not their encoded length.
+func requestBodySize(req events.APIGatewayProxyRequest) int {
+	if req.IsBase64Encoded {
+		return base64.StdEncoding.DecodedLen(len(req.Body))
+	}
+	return len(req.Body)
+}
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// requestBody undoes API Gateway's base64 encoding (binary passthrough) and
+// any Content-Encoding: gzip. Decompressed output is held to maxBodyBytes
+// too, so a small gzip bomb can't exhaust memory.
+func requestBody(req events.APIGatewayProxyRequest) ([]byte, error) {
+	body := []byte(req.Body)
+	if req.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(req.Body)
+		if err != nil {
+			return nil, fmt.Errorf("base64 decode failed: %v", err)
+		}
+		body = decoded
+	}
+
+	if !strings.EqualFold(strings.TrimSpace(headerValue(req.Headers, "Content-Encoding")), "gzip") {
+		return body, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("gzip decode failed: %v", err)
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(io.LimitReader(zr, int64(maxBodyBytes)+1))
+	if err != nil {
+		return nil, fmt.Errorf("gzip decode failed: %v", err)
+	}
+	if len(data) > maxBodyBytes {
+		return nil, errBodyTooLarge
+	}
+	return data, nil
+}
+
+// acceptedContentType allows JSON (including +json types) and gzip bodies.
+// A missing header is let through since many clients don't send one.
+func acceptedContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "application/json", strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json"):
+		return true
+	case mediaType == "application/gzip", mediaType == "application/x-gzip":
+		return true
+	}
+	return false
+}
+
+func Handler(ctx context.Context, req events.APIGatewayProxyRequest) (resp events.APIGatewayProxyResponse, err error) {
+	logger := slog.Default().With("requestId", req.RequestContext.RequestID)
+	ctx = withLogger(withStorageTimer(ctx), logger)
+
+	// One metric per invocation, rejections before dispatch included; the
+	// action stays "unknown" until the request is parsed
+	action := ""
+	defer func() {
+		var actionErr error
+		if resp.StatusCode >= 500 {
+			actionErr = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		recordMetric(action, storageTime(ctx), actionErr)
+	}()
+
+	// Preflight carries no credentials or body
+	if req.HTTPMethod == "OPTIONS" {
+		action = "preflight"
+		return preflightResponse(), nil
+	}
+
+	if size := requestBodySize(req); size > maxBodyBytes {
+		logger.Info("request body too large", "bytes", size, "limit", maxBodyBytes)
+		return lambdaResponse(clientError(413, fmt.Sprintf("Request body exceeds %d bytes", maxBodyBytes))), nil
+	}
+
+	ctx, err = withCaller(ctx, req.Headers)
+	if err != nil {
+		logger.Info("unauthorized", "error", err)
+		return lambdaResponse(clientError(401, fmt.Sprintf("Unauthorized: %v", err))), nil
+	}
+	logger = loggerFrom(ctx)
+
+	if checkContentType && strings.TrimSpace(req.Body) != "" && !acceptedContentType(headerValue(req.Headers, "Content-Type")) {
+		logger.Info("unsupported content type", "contentType", headerValue(req.Headers, "Content-Type"))
+		return lambdaResponse(clientError(415, "unsupported media type")), nil
+	}
+
+	body, err := requestBody(req)
+	if errors.Is(err, errBodyTooLarge) {
+		logger.Info("decompressed request body too large", "limit", maxBodyBytes)
+		return lambdaResponse(clientError(413, fmt.Sprintf("Request body exceeds %d bytes", maxBodyBytes))), nil
+	}
+	if err != nil {
+		logger.Info("undecodable request body", "error", err)
+		return lambdaResponse(clientError(400, "Malformed request body encoding")), nil
+	}
+
+	// Parse body (REST-style GETs may not send one)
+	var input APIRequest
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &input); err != nil {
+			logger.Info("invalid request body", "error", err)
+			return lambdaResponse(clientError(400, "Invalid JSON body")), nil
+		}
+	}
+
+	// Body wins; otherwise take action/filename from the path or query string
+	if input.Action == "" {
+		input.Action = firstNonEmpty(req.PathParameters["action"], req.QueryStringParameters["action"])
+	}
+	action = input.Action
+	if input.Filename == "" {
+		input.Filename = firstNonEmpty(req.PathParameters["filename"], req.QueryStringParameters["filename"])
+	}
+	if input.IdempotencyKey == "" {
+		input.IdempotencyKey = headerValue(req.Headers, "Idempotency-Key")
+	}
+	if input.IfModifiedSince == "" {
+		input.IfModifiedSince = headerValue(req.Headers, "If-Modified-Since")
+	}
+	if input.IfNoneMatch == "" {
+		input.IfNoneMatch = headerValue(req.Headers, "If-None-Match")
+	}
+	if input.Version == "" {
+		input.Version = headerValue(req.Headers, "Accept-Version")
+	}
+
+	if status, payload, ok := checkAllowed(ctx, input.Action); !ok {
+		return lambdaResponse(status, payload), nil
+	}
+
+	ctx, span := tracer.Start(extractTraceContext(ctx, req.Headers), "Handler", trace.WithAttributes(
+		attribute.String("action", input.Action),
+		attribute.String("filename", input.Filename),
+	))
+	defer flushTraces(ctx)
+	defer span.End()
+
+	status, payload := dispatch(ctx, input)
+	span.SetAttributes(attribute.Int("http.status_code", status))
+
+	logger.Info("request handled", "action", input.Action, "filename", input.Filename, "status", status)
+	return lambdaResponse(status, payload), nil
+}
+
+// dispatch runs a parsed request and returns the status code and payload,
+// independent of transport. Both the Lambda Handler and the local Gin routes
+// are thin adapters over it so the two modes can't drift apart.
+func dispatch(ctx context.Context, input APIRequest) (status int, payload interface{}) {
+	owner := subjectFrom(ctx)
+
+	ctx = withWarnings(ctx)
+	defer func() { payload = attachWarnings(ctx, status, payload) }()
+
+	start := time.Now()
+	defer func() { observeDispatch(input.Action, status, time.Since(start)) }()
+
+	ctx, cancel := withActionTimeout(ctx, input.Action)
+	defer cancel()
+
+	// Reads never put an object, so only writes pay for building tags
+	if writeActions[input.Action] {
+		tags, err := requestTags(ctx, input.Tags)
+		if err != nil {
+			return clientError(400, err.Error())
+		}
+		ctx = withObjectTags(ctx, tags)
+	}
+
+	if input.Version != "" && !supportedAPIVersions[input.Version] {
+		return clientError(400, fmt.Sprintf("unsupported API version %q", input.Version))
+	}
+
+	if readOnly && writeActions[input.Action] {
+		return clientError(403, "read-only mode")
+	}
+
+	if input.Bucket != "" && input.Bucket != bucketName {
+		if !allowedBuckets[input.Bucket] {
+			return clientError(403, "bucket not allowed")
+		}
+		ctx = withBucket(ctx, input.Bucket)
+	}
+
+	if input.Action == "health" {
+		return healthResponse(ctx)
+	}
+
+	if input.Action == "list" {
+		objects, err := store.List(ctx, dataPrefix+ownerPrefix(owner)+input.Prefix)
+		if isTimeout(err) {
+			return clientError(504, "storage timeout")
+		}
+		if err != nil {
+			return clientError(500, fmt.Sprintf("List failed: %v", err))
+		}
+
+		filenames := []string{}
+		files := []FileInfo{}
+		for _, obj := range objects {
+			name, ok := filenameFromKey(obj.Key, owner)
+			if partitionByDate {
+				name, _, ok = partitionFromKey(obj.Key, owner)
+			}
+			if !ok {
+				continue
+			}
+			// Partitions of one file are listed together, so they're adjacent
+			if n := len(files); n > 0 && files[n-1].Filename == name {
+				files[n-1].Size += obj.Size
+				if modified := obj.LastModified.UTC().Format(time.RFC3339); !obj.LastModified.IsZero() && modified > files[n-1].LastModified {
+					files[n-1].LastModified = modified
+				}
+				continue
+			}
+			filenames = append(filenames, name)
+			info := FileInfo{Filename: name, Size: obj.Size}
+			if !obj.LastModified.IsZero() {
+				info.LastModified = obj.LastModified.UTC().Format(time.RFC3339)
+			}
+			files = append(files, info)
+		}
+		if input.NamesOnly {
+			return successResponse(filenames)
+		}
+		return successResponse(files)
+	}
+
+	if input.Action == "presignUpload" {
+		return presignUploadResponse(ctx, owner, input.Format)
+	}
+
+	if input.Filename == "" {
+		input.Filename = defaultFilename
+	}
+	if input.Action == "" || input.Filename == "" {
+		return clientError(400, "Missing 'action' or 'filename'")
+	}
+	if err := validateFilename(input.Filename); err != nil {
+		return clientError(400, "invalid filename")
+	}
+
+	s3Key := dataPrefix + buildS3Key(owner, input.Filename)
+
+	if recordMode == "generic" {
+		return handleRecordAction(ctx, input, s3Key)
+	}
+
+	if err := validateRedact(input.Redact); err != nil {
+		return clientError(400, err.Error())
+	}
+	redact := redactionsFor(ctx, input.Redact)
+	// Only the role's redactions are enforced; a request may filter on a
+	// field it chose to hide from itself
+	if field := redactedQueryField(input, redactionsFor(ctx, nil)); field != "" {
+		return clientError(403, fmt.Sprintf("%s is redacted for this role", field))
+	}
+
+	if partitionByDate {
+		if input.Action == "get" && input.Partition == "" {
+			return getPartitioned(ctx, owner, input)
+		}
+		key, err := partitionedKey(owner, input)
+		if err != nil {
+			return clientError(400, err.Error())
+		}
+		s3Key = key
+		if fields := partitionDateFields(input); fields != nil {
+			return validationError(fields)
+		}
+	}
+
+	if input.UUID != "" && input.ID == 0 {
+		id, err := resolveUUID(ctx, s3Key, input.UUID)
+		if err != nil {
+			return readError(err)
+		}
+		if id == 0 {
+			return clientError(404, "message not found")
+		}
+		input.ID = id
+	}
+
+	switch input.Action {
+	case "get":
+		// Conditional get: a cheap HEAD decides whether the body is needed
+		if input.IfModifiedSince != "" {
+			since, err := parseHTTPTimestamp(input.IfModifiedSince)
+			if err != nil {
+				return clientError(400, "ifModifiedSince must be RFC3339")
+			}
+
+			meta, err := store.Head(ctx, s3Key)
+			if err != nil {
+				return readError(err)
+			}
+			// S3 timestamps have second precision
+			if !meta.LastModified.IsZero() && !meta.LastModified.Truncate(time.Second).After(since.Truncate(time.Second)) {
+				return notModifiedResponse(meta)
+			}
+		}
+
+		from, to, err := parseDateRange(input.From, input.To)
+		if err != nil {
+			return clientError(400, err.Error())
+		}
+
+		messages, meta, err := store.Get(ctx, s3Key)
+		if err != nil {
+			return readError(err)
+		}
+		noteMessageCount(ctx, len(messages))
+		if input.AfterUUID != "" && input.AfterID == 0 {
+			// Tombstones keep their UUID, so a cursor survives its message's delete
+			idx := slices.IndexFunc(messages, func(m Message) bool { return m.UUID == input.AfterUUID })
+			if idx == -1 {
+				return clientError(400, "unknown afterUuid cursor")
+			}
+			input.AfterID = messages[idx].ID
+		}
+		if !input.IncludeDeleted {
+			messages = liveMessages(messages)
+		}
+		messages = filterMessages(messages, input.Sender, input.Receiver)
+		if !from.IsZero() || !to.IsZero() {
+			messages = filterDateRange(messages, from, to, input.IncludeUndated)
+		}
+
+		if input.AfterID > 0 {
+			// Cursors walk IDs upward, so deletes mid-scroll can't shift pages
+			if (input.SortBy != "" && input.SortBy != "id") || (input.SortDir != "" && input.SortDir != "asc") || input.Offset != 0 {
+				return clientError(400, "afterId can't be combined with sortBy, sortDir or offset")
+			}
+			messages = messagesAfter(messages, input.AfterID)
+		}
+		if err := sortMessages(messages, input.SortBy, input.SortDir); err != nil {
+			return clientError(400, err.Error())
+		}
+		if err := validateFields(input.Fields); err != nil {
+			return clientError(400, err.Error())
+		}
+
+		page := redactMessages(paginate(messages, input.Offset, input.Limit), redact)
+		var data interface{} = page
+		if len(input.Fields) > 0 {
+			data = projectMessages(page, input.Fields)
+		}
+		resp := APIResponse{
+			Status: "ok",
+			Data:   data,
+			Total:  len(messages),
+			ETag:   meta.ETag,
+			// Stores report a missing file as empty with no version
+			Exists: aws.Bool(meta.ETag != ""),
+		}
+		if (input.SortBy == "" || input.SortBy == "id") && (input.SortDir == "" || input.SortDir == "asc") {
+			resp.NextCursor = nextCursor(page, input.Offset+len(page) < len(messages))
+		}
+		if !meta.LastModified.IsZero() {
+			resp.LastModified = meta.LastModified.UTC().Format(time.RFC3339)
+		}
+		return cacheableResponse(resp, input.IfNoneMatch)
+
+	case "getById":
+		if input.ID <= 0 {
+			return clientError(400, "Missing or invalid 'id' for getById")
+		}
+
+		messages, _, err := store.Get(ctx, s3Key)
+		if err != nil {
+			return readError(err)
+		}
+		noteMessageCount(ctx, len(messages))
+
+		idx := findMessageIndex(messages, input.ID)
+		if idx == -1 {
+			return clientError(404, "message not found")
+		}
+		return successResponse(redactMessage(messages[idx], redact))
+
+	case "thread":
+		if input.ID <= 0 {
+			return clientError(400, "Missing or invalid 'id' for thread")
+		}
+
+		messages, _, err := store.Get(ctx, s3Key)
+		if err != nil {
+			return readError(err)
+		}
+		noteMessageCount(ctx, len(messages))
+		messages = liveMessages(messages)
+
+		thread := threadMessages(messages, input.ID)
+		if thread == nil {
+			return clientError(404, "message not found")
+		}
+		return successResponse(APIResponse{Status: "ok", Data: redactMessages(thread, redact), Total: len(thread)})
+
+	case "tail":
+		limit := input.Limit
+		if limit <= 0 {
+			limit = defaultTailLimit
+		}
+
+		scanned := 0
+		messages, err := store.Tail(ctx, s3Key, limit, countingScan(&scanned, func(m Message) bool {
+			return (input.IncludeDeleted || !m.Deleted) && matchesParticipants(m, input.Sender, input.Receiver)
+		}))
+		if err != nil {
+			return readError(err)
+		}
+		noteMessageCount(ctx, scanned)
+		return successResponse(APIResponse{Status: "ok", Data: redactMessages(messages, redact), Total: len(messages)})
+
+	case "distinct":
+		if input.Field != "sender" && input.Field != "receiver" {
+			return clientError(400, "field must be sender or receiver")
+		}
+
+		seen := map[string]bool{}
+		scanned := 0
+		_, err := store.Scan(ctx, s3Key, countingScan(&scanned, func(m Message) bool {
+			if !m.Deleted {
+				if input.Field == "sender" {
+					seen[m.Sender] = true
+				} else {
+					seen[m.Receiver] = true
+				}
+			}
+			return false // Only the set is needed, not the messages
+		}))
+		if err != nil {
+			return readError(err)
+		}
+		noteMessageCount(ctx, scanned)
+
+		values := make([]string, 0, len(seen))
+		for v := range seen {
+			values = append(values, v)
+		}
+		sort.Strings(values)
+		return successResponse(APIResponse{Status: "ok", Data: values, Total: len(values)})
+
+	case "count":
+		scanned := 0
+		messages, err := store.Scan(ctx, s3Key, countingScan(&scanned, func(m Message) bool {
+			return !m.Deleted && matchesParticipants(m, input.Sender, input.Receiver)
+		}))
+		if err != nil {
+			return readError(err)
+		}
+		noteMessageCount(ctx, scanned)
+
+		return successResponse(APIResponse{
+			Status: "ok",
+			Data:   map[string]int{"count": len(messages)},
+		})
+
+	case "presign":
+		if storeBackend == "dynamodb" {
+			return clientError(400, "presign requires the S3 backend")
+		}
+		// The URL serves the stored file as is
+		if len(redact) > 0 {
+			return clientError(403, "presign isn't available with redacted fields")
+		}
+		if idStrategy == "uuid" {
+			return clientError(400, "presign isn't available with ID_STRATEGY=uuid")
+		}
+		// buildS3Key can't leave the caller's prefix for a valid filename;
+		// checked again since a URL outlives this request's auth
+		if !strings.HasPrefix(s3Key, dataPrefix+ownerPrefix(owner)) {
+			return clientError(403, "key outside allowed prefix")
+		}
+
+		meta, err := store.Head(ctx, s3Key)
+		if err != nil {
+			return readError(err)
+		}
+		if meta.ETag == "" {
+			return clientError(404, "file not found")
+		}
+
+		expiresAt := time.Now().UTC().Add(presignTTL)
+		presigned, err := presignS3Get(ctx, s3Client, bucketFrom(ctx), s3Key, presignTTL)
+		if err != nil {
+			return clientError(500, err.Error())
+		}
+		return successResponse(APIResponse{Status: "ok", Data: map[string]string{
+			"url":       presigned,
+			"expiresAt": expiresAt.Format(time.RFC3339),
+		}})
+
+	case "export":
+		messages, _, err := store.Get(ctx, s3Key)
+		if err != nil {
+			return readError(err)
+		}
+		noteMessageCount(ctx, len(messages))
+		messages = redactMessages(liveMessages(messages), redact)
+
+		switch input.Format {
+		case "", "json":
+			return successResponse(messages)
+		case "csv":
+			data, err := messagesToCSV(messages)
+			if err != nil {
+				return clientError(500, fmt.Sprintf("Export failed: %v", err))
+			}
+			return binaryResponse(data, "text/csv", input.Filename+".csv")
+		case "ndjson":
+			data, err := messagesToNDJSON(messages)
+			if err != nil {
+				return clientError(500, fmt.Sprintf("Export failed: %v", err))
+			}
+			return binaryResponse(data, "application/x-ndjson", input.Filename+".ndjson")
+		default:
+			return clientError(400, "format must be csv, json or ndjson")
+		}
+
+	case "search":
+		if input.Message == "" {
+			return clientError(400, "Missing 'message' search query")
+		}
+
+		query := strings.ToLower(input.Message)
+		scanned := 0
+		messages, err := store.Scan(ctx, s3Key, countingScan(&scanned, func(m Message) bool {
+			return !m.Deleted && matchesQuery(m, query)
+		}))
+		if err != nil {
+			return readError(err)
+		}
+		noteMessageCount(ctx, scanned)
+		return successResponse(redactMessages(messages, redact))
+
+	case "add":
+		if fields := validateMessageInput(&input); fields != nil {
+			return validationError(fields)
+		}
+
+		var newMsg Message
+		replayed, deduped := false, false
+		err := modifyMessages(ctx, s3Key, input.DryRun, func(messages AllMessages) (AllMessages, error) {
+			now := time.Now().UTC()
+			expireIdempotencyKeys(messages, now)
+
+			// A retried request gets the original message back, nothing is written
+			if input.IdempotencyKey != "" {
+				if idx := findIdempotentMessage(messages, input.IdempotencyKey); idx != -1 {
+					newMsg = messages[idx]
+					replayed = true
+					return nil, nil
+				}
+			}
+			replayed = false
+
+			if input.DedupOnAdd {
+				if last, ok := lastLiveMessage(messages); ok && isDuplicate(last, input) {
+					newMsg = last
+					deduped = true
+					return nil, nil
+				}
+			}
+			deduped = false
+
+			if err := checkCapacity(messages, 1); err != nil {
+				return nil, err
+			}
+
+			// Max + 1 rather than last + 1: IDs may be out of order after
+			// upserts and imports, and tombstones keep their IDs reserved
+			newMsg = Message{
+				ID:         maxMessageID(messages) + 1,
+				Sender:     input.Sender,
+				Receiver:   input.Receiver,
+				Message:    input.Message,
+				Date:       input.Date,
+				ParentID:   input.ParentID,
+				ParentUUID: input.ParentUUID,
+				CreatedAt:  now.Format(time.RFC3339),
+			}
+			if err := linkParent(&newMsg, messages); err != nil {
+				return nil, err
+			}
+			if newMsg.ParentID != 0 && findMessageIndex(messages, newMsg.ParentID) == -1 {
+				return nil, errParentNotFound
+			}
+			assignUUID(&newMsg)
+			if input.IdempotencyKey != "" {
+				newMsg.IdempotencyKey = input.IdempotencyKey
+				newMsg.IdempotencyExpires = now.Add(idempotencyTTL).Format(time.RFC3339)
+			}
+
+			return append(messages, newMsg), nil
+		})
+		if err != nil {
+			return mutationError(err)
+		}
+
+		shown := redactMessage(newMsg, redact)
+		if deduped {
+			if input.DryRun {
+				return dryRunResponse("deduped", shown)
+			}
+			return successResponse(dedupedMessage{Message: shown, Deduped: true})
+		}
+		if input.DryRun {
+			return dryRunResponse("created", shown)
+		}
+		if !replayed {
+			recordAudit(ctx, AuditEntry{Action: input.Action, Filename: input.Filename, MessageID: newMsg.ID})
+		}
+		return createdResponse(shown, messageLocation(input.Filename, publicID(newMsg)))
+
+	case "addMany":
+		if len(input.Messages) == 0 {
+			return clientError(400, "Missing 'messages' for addMany")
+		}
+		for i := range input.Messages {
+			if fields := validateMessage(&input.Messages[i]); fields != nil {
+				// Report only the first bad entry, keyed by its index
+				return validationError(prefixFields(fields, fmt.Sprintf("messages[%d].", i)))
+			}
+		}
+
+		var added AllMessages
+		err := modifyMessages(ctx, s3Key, input.DryRun, func(messages AllMessages) (AllMessages, error) {
+			if err := checkCapacity(messages, len(input.Messages)); err != nil {
+				return nil, err
+			}
+			nextID := maxMessageID(messages) + 1
+			createdAt := serverTimestamp()
+
+			added = make(AllMessages, len(input.Messages))
+			for i, m := range input.Messages {
+				clearServerFields(&m)
+				m.ID = nextID + i
+				m.CreatedAt = createdAt
+				assignUUID(&m)
+				if err := linkParent(&m, messages); err != nil {
+					return nil, &patchValidationError{fields: map[string]string{fmt.Sprintf("messages[%d].parentUuid", i): "parent message not found"}}
+				}
+				added[i] = m
+			}
+			// Replies may only target messages already in the file
+			if fields := invalidParents(added, messages); fields != nil {
+				return nil, &patchValidationError{fields: fields}
+			}
+
+			return append(messages, added...), nil
+		})
+		var invalid *patchValidationError
+		if errors.As(err, &invalid) {
+			return validationError(invalid.fields)
+		}
+		if err != nil {
+			return mutationError(err)
+		}
+
+		if input.DryRun {
+			return dryRunResponse("created", redactMessages(added, redact))
+		}
+		recordAudit(ctx, AuditEntry{Action: input.Action, Filename: input.Filename, MessageIDs: messageIDs(added)})
+		return successResponse(redactMessages(added, redact))
+
+	case "upsert":
+		if input.ID <= 0 {
+			return clientError(400, "Missing or invalid 'id' for upsert")
+		}
+		msg := Message{
+			ID:         input.ID,
+			Sender:     input.Sender,
+			Receiver:   input.Receiver,
+			Message:    input.Message,
+			Date:       input.Date,
+			ParentID:   input.ParentID,
+			ParentUUID: input.ParentUUID,
+		}
+		if fields := validateMessage(&msg); fields != nil {
+			return validationError(fields)
+		}
+
+		created := false
+		err := modifyMessages(ctx, s3Key, input.DryRun, func(messages AllMessages) (AllMessages, error) {
+			if err := linkParent(&msg, messages); err != nil {
+				return nil, err
+			}
+			if msg.ParentID != 0 && (msg.ParentID == msg.ID || findMessageIndex(messages, msg.ParentID) == -1) {
+				return nil, errParentNotFound
+			}
+
+			// A tombstone with this ID is revived in place so IDs stay unique
+			for i := range messages {
+				if messages[i].ID == msg.ID {
+					created = messages[i].Deleted
+					msg.UUID = messages[i].UUID
+					if created {
+						msg.CreatedAt = serverTimestamp()
+					} else {
+						msg.CreatedAt, msg.UpdatedAt = messages[i].CreatedAt, serverTimestamp()
+					}
+					assignUUID(&msg)
+					messages[i] = msg
+					return messages, nil
+				}
+			}
+
+			created = true
+			msg.CreatedAt = serverTimestamp()
+			assignUUID(&msg)
+			return append(messages, msg), nil
+		})
+		if err != nil {
+			return mutationError(err)
+		}
+
+		status := "updated"
+		if created {
+			status = "created"
+		}
+		shown := redactMessage(msg, redact)
+		if input.DryRun {
+			return dryRunResponse(status, shown)
+		}
+		recordAudit(ctx, AuditEntry{Action: input.Action, Filename: input.Filename, MessageID: msg.ID})
+		if created {
+			return createdResponse(APIResponse{Status: status, Data: shown}, messageLocation(input.Filename, publicID(msg)))
+		}
+		return successResponse(APIResponse{Status: status, Data: shown})
+
+	case "import":
+		if input.Mode != "append" && input.Mode != "replace" {
+			return clientError(400, "mode must be append or replace")
+		}
+		var raw []byte
+		var err error
+		if input.StagingKey != "" {
+			if !validStagingKey(input.StagingKey, owner) {
+				return clientError(403, "stagingKey outside the staging prefix")
+			}
+			raw, err = readStagedUpload(ctx, s3Client, bucketFrom(ctx), input.StagingKey)
+			switch {
+			case errors.Is(err, ErrFileNotFound):
+				return clientError(404, "staged upload not found")
+			case errors.Is(err, ErrFileTooLarge):
+				return clientError(413, "staged upload too large")
+			case err != nil:
+				return readError(err)
+			}
+		} else {
+			raw, err = base64.StdEncoding.DecodeString(input.Content)
+			if err != nil || len(raw) == 0 {
+				return clientError(400, "Missing or invalid base64 'content' for import")
+			}
+		}
+
+		var imported AllMessages
+		var fields map[string]string
+		switch input.Format {
+		case "", "json":
+			imported, fields, err = parseJSONImport(raw)
+		case "csv":
+			imported, fields, err = parseCSVImport(raw)
+		default:
+			return clientError(400, "format must be csv or json")
+		}
+		if err != nil {
+			return clientError(400, fmt.Sprintf("Import parse failed: %v", err))
+		}
+		// All-or-nothing: one bad row rejects the whole import
+		if fields != nil {
+			return validationError(fields)
+		}
+		if partitionByDate {
+			if fields := datesOutsidePartition(imported, input.Partition); fields != nil {
+				return validationError(fields)
+			}
+		}
+		fields = map[string]string{}
+		for i, m := range imported {
+			problems, err := validateSchema(ctx, m)
+			if err != nil {
+				return clientError(500, err.Error())
+			}
+			for name, problem := range prefixFields(problems, fmt.Sprintf("messages[%d].", i)) {
+				fields[name] = problem
+			}
+		}
+		if len(fields) > 0 {
+			return validationError(fields)
+		}
+
+		err = modifyMessages(ctx, s3Key, input.DryRun, func(messages AllMessages) (AllMessages, error) {
+			if input.Mode == "replace" {
+				messages = AllMessages{}
+			}
+			if err := checkCapacity(messages, len(imported)); err != nil {
+				return nil, err
+			}
+
+			nextID := maxMessageID(messages) + 1
+			createdAt := serverTimestamp()
+			renumbered := importedIDs(imported, nextID)
+			for i := range imported {
+				// Parents point at the source file's IDs: follow them to the
+				// renumbered message, or drop a reply whose parent wasn't exported
+				imported[i].ParentID = renumbered[imported[i].ParentID]
+				imported[i].ID = nextID + i
+				imported[i].CreatedAt = createdAt
+				assignUUID(&imported[i])
+			}
+			linkParents(imported)
+			return append(messages, imported...), nil
+		})
+		if err != nil {
+			return mutationError(err)
+		}
+
+		result := map[string]interface{}{"count": len(imported), "mode": input.Mode}
+		if input.DryRun {
+			return dryRunResponse("imported", result)
+		}
+		if input.StagingKey != "" {
+			// Best effort: an upload left behind is only clutter
+			if err := deleteS3Object(ctx, s3Client, bucketFrom(ctx), input.StagingKey); err != nil {
+				loggerFrom(ctx).Error("staged upload cleanup failed", "key", input.StagingKey, "error", err)
+			}
+		}
+		recordAudit(ctx, AuditEntry{Action: input.Action, Filename: input.Filename, MessageIDs: messageIDs(imported)})
+		return successResponse(APIResponse{Status: "imported", Data: result})
+
+	case "replace":
+		if input.Messages == nil {
+			return clientError(400, "Missing 'messages' for replace")
+		}
+		for i := range input.Messages {
+			if fields := validateMessage(&input.Messages[i]); fields != nil {
+				return validationError(prefixFields(fields, fmt.Sprintf("messages[%d].", i)))
+			}
+		}
+		replaced, err := normalizeIDs(input.Messages)
+		if err != nil {
+			return clientError(400, err.Error())
+		}
+		if fields := invalidParents(replaced, replaced); fields != nil {
+			return validationError(fields)
+		}
+		linkParents(replaced)
+
+		result := map[string]int{"count": len(replaced)}
+		if input.DryRun {
+			return dryRunResponse("replaced", result)
+		}
+		// The client sent the whole desired state, so there's nothing to merge:
+		// overwrite unconditionally instead of read-modify-write
+		if err := store.Put(ctx, s3Key, replaced, ""); err != nil {
+			return mutationError(err)
+		}
+		recordAudit(ctx, AuditEntry{Action: input.Action, Filename: input.Filename, MessageIDs: messageIDs(replaced)})
+		return successResponse(APIResponse{Status: "replaced", Data: result})
+
+	case "deleteFile":
+		// Wiping a whole conversation can't be undone, so make it explicit
+		if !input.Confirm {
+			return clientError(400, "deleteFile requires 'confirm': true")
+		}
+		if input.DryRun {
+			meta, err := store.Head(ctx, s3Key)
+			if err != nil {
+				return readError(err)
+			}
+			if meta.ETag == "" {
+				return clientError(404, "file not found")
+			}
+			return dryRunResponse("deleted", map[string]string{"filename": input.Filename})
+		}
+
+		if err := store.Delete(ctx, s3Key); err != nil {
+			return mutationError(err)
+		}
+		recordAudit(ctx, AuditEntry{Action: input.Action, Filename: input.Filename})
+		return successResponse(APIResponse{Status: "deleted", Data: map[string]string{"filename": input.Filename}})
+
+	case "rename":
+		if err := validateFilename(input.NewFilename); err != nil {
+			return clientError(400, "invalid newFilename")
+		}
+		if input.NewFilename == input.Filename {
+			return clientError(400, "newFilename must differ from filename")
+		}
+		dstKey := dataPrefix + buildS3Key(owner, input.NewFilename)
+
+		result := map[string]string{"filename": input.NewFilename}
+		if input.DryRun {
+			return dryRunResponse("renamed", result)
+		}
+		// S3 has no rename: copy, then remove the original
+		if err := store.Copy(ctx, s3Key, dstKey, input.Overwrite); err != nil {
+			return mutationError(err)
+		}
+		if err := store.Delete(ctx, s3Key); err != nil && !errors.Is(err, ErrFileNotFound) {
+			return mutationError(err)
+		}
+		recordAudit(ctx, AuditEntry{Action: input.Action, Filename: input.Filename})
+		return successResponse(APIResponse{Status: "renamed", Data: result})
+
+	case "archive":
+		before, err := parseMessageDate(input.Before)
+		if err != nil {
+			return clientError(400, "Missing or invalid 'before' for archive (RFC3339 or YYYY-MM-DD)")
+		}
+
+		result, err := archiveMessages(ctx, owner, input.Filename, s3Key, before, input.DryRun)
+		if err != nil {
+			return mutationError(err)
+		}
+		if input.DryRun {
+			return dryRunResponse("archived", result)
+		}
+		recordAudit(ctx, AuditEntry{Action: input.Action, Filename: input.Filename})
+		return successResponse(APIResponse{Status: "archived", Data: result})
+
+	case "createFile":
+		messages := input.Messages
+		if messages == nil {
+			messages = AllMessages{}
+		}
+		for i := range messages {
+			if fields := validateMessage(&messages[i]); fields != nil {
+				return validationError(prefixFields(fields, fmt.Sprintf("messages[%d].", i)))
+			}
+		}
+		created, err := normalizeIDs(messages)
+		if err != nil {
+			return clientError(400, err.Error())
+		}
+		if fields := invalidParents(created, created); fields != nil {
+			return validationError(fields)
+		}
+		linkParents(created)
+
+		result := map[string]interface{}{"filename": input.Filename, "count": len(created)}
+		if input.DryRun {
+			return dryRunResponse("created", result)
+		}
+		// Create-only: no read first, the backend refuses if the file exists
+		err = store.Put(ctx, s3Key, created, versionAbsent)
+		if errors.Is(err, ErrPreconditionFailed) {
+			return clientError(409, "file already exists")
+		}
+		if err != nil {
+			return mutationError(err)
+		}
+		recordAudit(ctx, AuditEntry{Action: input.Action, Filename: input.Filename, MessageIDs: messageIDs(created)})
+		return createdResponse(APIResponse{Status: "created", Data: result}, messagesLocation(input.Filename))
+
+	case "patch":
+		if input.ID <= 0 {
+			return clientError(400, "Missing or invalid 'id' for patch")
+		}
+		patch, err := parsePatch(input.Patch)
+		if err != nil {
+			return clientError(400, err.Error())
+		}
+
+		var patched Message
+		err = modifyMessages(ctx, s3Key, input.DryRun, func(messages AllMessages) (AllMessages, error) {
+			idx := findMessageIndex(messages, input.ID)
+			if idx == -1 {
+				return nil, errMessageNotFound
+			}
+
+			msg, fields, err := applyMergePatch(messages[idx], patch)
+			if err != nil {
+				return nil, err
+			}
+			if fields != nil {
+				return nil, &patchValidationError{fields: fields}
+			}
+			if err := linkPatchedParent(&msg, patch, messages); err != nil {
+				return nil, err
+			}
+			if msg.ParentID != 0 && (msg.ParentID == msg.ID || findMessageIndex(messages, msg.ParentID) == -1) {
+				return nil, errParentNotFound
+			}
+			msg.UpdatedAt = serverTimestamp()
+
+			messages[idx] = msg
+			patched = msg
+			return messages, nil
+		})
+		var invalid *patchValidationError
+		if errors.As(err, &invalid) {
+			return validationError(invalid.fields)
+		}
+		if err != nil {
+			return mutationError(err)
+		}
+
+		if input.DryRun {
+			return dryRunResponse("updated", redactMessage(patched, redact))
+		}
+		recordAudit(ctx, AuditEntry{Action: input.Action, Filename: input.Filename, MessageID: patched.ID})
+		return successResponse(redactMessage(patched, redact))
+
+	case "updateWhere":
+		// An empty filter matches everything; make that explicit
+		if input.Sender == "" && input.Receiver == "" && !input.All {
+			return clientError(400, "updateWhere needs 'sender' or 'receiver', or 'all': true")
+		}
+		patch, err := parsePatch(input.Patch)
+		if err != nil {
+			return clientError(400, err.Error())
+		}
+
+		var updated AllMessages
+		err = modifyMessages(ctx, s3Key, input.DryRun, func(messages AllMessages) (AllMessages, error) {
+			updated = AllMessages{}
+			now := serverTimestamp()
+			for i, m := range messages {
+				if m.Deleted || !matchesParticipants(m, input.Sender, input.Receiver) {
+					continue
+				}
+
+				msg, fields, err := applyMergePatch(m, patch)
+				if err != nil {
+					return nil, err
+				}
+				if fields != nil {
+					return nil, &patchValidationError{fields: prefixFields(fields, fmt.Sprintf("messages[%d].", i))}
+				}
+				if err := linkPatchedParent(&msg, patch, messages); err != nil {
+					return nil, err
+				}
+				if msg.ParentID != 0 && (msg.ParentID == msg.ID || findMessageIndex(messages, msg.ParentID) == -1) {
+					return nil, errParentNotFound
+				}
+				msg.UpdatedAt = now
+
+				messages[i] = msg
+				updated = append(updated, msg)
+			}
+
+			// Nothing matched → nothing to write
+			if len(updated) == 0 {
+				return nil, nil
+			}
+			return messages, nil
+		})
+		var invalid *patchValidationError
+		if errors.As(err, &invalid) {
+			return validationError(invalid.fields)
+		}
+		if err != nil {
+			return mutationError(err)
+		}
+
+		result := map[string]interface{}{"count": len(updated), "ids": publicIDs(updated)}
+		if input.DryRun {
+			return dryRunResponse("updated", result)
+		}
+		if len(updated) > 0 {
+			recordAudit(ctx, AuditEntry{Action: input.Action, Filename: input.Filename, MessageIDs: messageIDs(updated)})
+		}
+		return successResponse(APIResponse{Status: "updated", Data: result})
+
+	case "update":
+		if input.ID <= 0 {
+			return clientError(400, "Missing or invalid 'id' for update")
+		}
+		if fields := validateMessageInput(&input); fields != nil {
+			return validationError(fields)
+		}
+
+		var updated Message
+		err := modifyMessages(ctx, s3Key, input.DryRun, func(messages AllMessages) (AllMessages, error) {
+			idx := findMessageIndex(messages, input.ID)
+			if idx == -1 {
+				return nil, errMessageNotFound
+			}
+
+			// Only overwrite fields that were sent
+			msg := &messages[idx]
+			if input.Sender != "" {
+				msg.Sender = input.Sender
+			}
+			if input.Receiver != "" {
+				msg.Receiver = input.Receiver
+			}
+			if input.Message != "" {
+				msg.Message = input.Message
+			}
+			if input.Date != "" {
+				msg.Date = input.Date
+			}
+			msg.UpdatedAt = serverTimestamp()
+
+			updated = *msg
+			return messages, nil
+		})
+		if err != nil {
+			return mutationError(err)
+		}
+
+		if input.DryRun {
+			return dryRunResponse("updated", redactMessage(updated, redact))
+		}
+		recordAudit(ctx, AuditEntry{Action: input.Action, Filename: input.Filename, MessageID: updated.ID})
+		return successResponse(redactMessage(updated, redact))
+
+	case "delete":
+		if input.ID <= 0 {
+			return clientError(400, "Missing or invalid 'id' for delete")
+		}
+
+		err := modifyMessages(ctx, s3Key, input.DryRun, func(messages AllMessages) (AllMessages, error) {
+			// Not found → nothing to write
+			idx := findMessageIndex(messages, input.ID)
+			if idx == -1 {
+				return nil, errMessageNotFound
+			}
+
+			// Soft delete: keep the message as a tombstone for audit history
+			messages[idx].Deleted = true
+			return messages, nil
+		})
+		if err != nil {
+			return mutationError(err)
+		}
+
+		// Echo the ID the caller sent; a resolved UUID's ID is internal
+		ref := map[string]interface{}{"id": input.ID}
+		if input.UUID != "" {
+			ref = map[string]interface{}{"uuid": input.UUID}
+		}
+		if input.DryRun {
+			return dryRunResponse("deleted", ref)
+		}
+		recordAudit(ctx, AuditEntry{Action: input.Action, Filename: input.Filename, MessageID: input.ID})
+		return successResponse(APIResponse{
+			Status: "deleted",
+			Data:   ref,
+		})
+
+	case "deleteMany":
+		if len(input.IDs) == 0 && len(input.UUIDs) == 0 {
+			return clientError(400, "Missing 'ids' or 'uuids' for deleteMany")
+		}
+
+		// Each reference is echoed the way the caller sent it, so UUIDs
+		// never come back as internal IDs
+		var deleted, notFound []interface{}
+		var deletedIDs []int
+		err := modifyMessages(ctx, s3Key, input.DryRun, func(messages AllMessages) (AllMessages, error) {
+			deleted, notFound, deletedIDs = []interface{}{}, []interface{}{}, []int{}
+			seen := map[interface{}]bool{}
+			remove := func(ref interface{}, idx int) {
+				if seen[ref] {
+					return
+				}
+				seen[ref] = true
+				if idx == -1 {
+					notFound = append(notFound, ref)
+					return
+				}
+				messages[idx].Deleted = true
+				deleted = append(deleted, ref)
+				deletedIDs = append(deletedIDs, messages[idx].ID)
+			}
+			for _, id := range input.IDs {
+				remove(id, findMessageIndex(messages, id))
+			}
+			for _, id := range input.UUIDs {
+				remove(id, findUUIDIndex(messages, id))
+			}
+
+			// None matched → nothing to write
+			if len(deleted) == 0 {
+				return nil, nil
+			}
+			return messages, nil
+		})
+		if err != nil {
+			return mutationError(err)
+		}
+
+		result := map[string]interface{}{"count": len(deleted), "deleted": deleted, "notFound": notFound}
+		if input.DryRun {
+			return dryRunResponse("deleted", result)
+		}
+		if len(deleted) > 0 {
+			recordAudit(ctx, AuditEntry{Action: input.Action, Filename: input.Filename, MessageIDs: deletedIDs})
+		}
+		return successResponse(APIResponse{Status: "deleted", Data: result})
+
+	default:
+		return clientError(400, "Invalid action. Use: get, getById, thread, tail, distinct, count, search, export, presign, presignUpload, add, addMany, import, replace, createFile, upsert, update, updateWhere, patch, delete, deleteMany, deleteFile, rename, archive, list, health")
+	}
+}
+
+// ======================
+// 🩹 Merge Patch
+// ======================
+
+// patchValidationError carries validation problems out of a modify callback.
+type patchValidationError struct {
+	fields map[string]string
+}
+
+func (e *patchValidationError) Error() string { return "validation failed" }
+
+// parsePatch decodes a merge patch and rejects fields that don't exist or
+// belong to the server.
+func parsePatch(raw json.RawMessage) (map[string]interface{}, error) {
+	var patch map[string]interface{}
+	if err := json.Unmarshal(raw, &patch); err != nil || patch == nil {
+		return nil, errors.New("Missing or invalid 'patch' object")
+	}
+	for name := range patch {
+		if !messageFields[name] {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+		if serverFields[name] {
+			return nil, fmt.Errorf("field %q is set by the server", name)
+		}
+	}
+	return patch, nil
+}
+
+// applyMergePatch applies an RFC 7386 merge patch to m: null removes a key,
+// objects merge recursively, anything else replaces. The result must still
+// be a valid message, so required fields can't be cleared.
+func applyMergePatch(m Message, patch map[string]interface{}) (Message, map[string]string, error) {
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return Message{}, nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return Message{}, nil, err
+	}
+
+	merged, err := json.Marshal(mergePatch(doc, patch))
+	if err != nil {
+		return Message{}, nil, err
+	}
+	var patched Message
+	if err := json.Unmarshal(merged, &patched); err != nil {
+		return Message{}, map[string]string{"patch": err.Error()}, nil
+	}
+	return patched, validateMessage(&patched), nil
+}
+
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+		} else {
+			targetObj[k] = mergePatch(targetObj[k], v)
+		}
+	}
+	return targetObj
+}
+
+// ======================
+// 🧊 Archive
+// ======================
+
+// archiveKey is where a file's messages from one year are archived, e.g.
+// archive/file1/2023.json.
+func archiveKey(owner, filename string, year int) string {
+	return fmt.Sprintf("archive/%s%s/%d.json", ownerPrefix(owner), filename, year)
+}
+
+// archiveMessages moves messages dated before the cutoff into per-year
+// archive files. The archives are written first and the source trimmed last,
+// so a failure part-way leaves copies rather than losing messages; archive
+// writes skip IDs already present, so a retry never duplicates them.
+func archiveMessages(ctx context.Context, owner, filename, s3Key string, before time.Time, dryRun bool) (map[string]interface{}, error) {
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		messages, meta, err := store.Get(ctx, s3Key)
+		if err != nil {
+			return nil, fmt.Errorf("get failed: %w", err)
+		}
+
+		// Messages whose date doesn't parse stay in the active file
+		byYear := map[int]AllMessages{}
+		kept := AllMessages{}
+		for _, m := range messages {
+			if t, err := parseMessageDate(m.Date); err == nil && t.Before(before) {
+				year := t.UTC().Year()
+				byYear[year] = append(byYear[year], m)
+				continue
+			}
+			kept = append(kept, m)
+		}
+
+		years := map[string]int{}
+		for year, archived := range byYear {
+			years[strconv.Itoa(year)] = len(archived)
+		}
+		result := map[string]interface{}{
+			"archived":  len(messages) - len(kept),
+			"remaining": len(kept),
+			"years":     years,
+		}
+		if dryRun || len(byYear) == 0 {
+			return result, nil
+		}
+
+		for year, archived := range byYear {
+			err := modifyMessages(ctx, archiveKey(owner, filename, year), false, func(existing AllMessages) (AllMessages, error) {
+				ids := map[int]bool{}
+				for _, m := range existing {
+					ids[m.ID] = true
+				}
+				for _, m := range archived {
+					if !ids[m.ID] {
+						existing = append(existing, m)
+					}
+				}
+				return existing, nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("archive %d failed: %w", year, err)
+			}
+		}
+
+		err = store.Put(ctx, s3Key, kept, meta.ETag)
+		if errors.Is(err, ErrPreconditionFailed) {
+			continue // Archived copies are kept; the next pass skips them
+		}
+		if err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+
+	return nil, errConcurrentModification
+}
+
+// ======================
+// 🔁 Read-Modify-Write
+// ======================
+
+const maxWriteAttempts = 3
+
+var (
+	errMessageNotFound        = errors.New("message not found")
+	errConcurrentModification = errors.New("concurrent modification")
+	errParentNotFound         = errors.New("parent message not found")
+	errFileFull               = errors.New("file full")
+)
+
+var (
+	// Set when serving over Gin; Lambda invocations never overlap in-process
+	localMode bool
+	// *sync.Mutex per storage key, serializing local read-modify-writes
+	fileLocks sync.Map
 )
 
-func init() {
-	err := godotenv.Load(".env")
-	if err != nil {
-		log.Println("⚠️ .env file not found, using OS environment variables")
+// lockFile serializes read-modify-writes of one key in local mode, where
+// concurrent requests would otherwise rely on the backend's precondition
+// checks alone. It returns the unlock function (a no-op on Lambda).
+func lockFile(key string) func() {
+	if !localMode {
+		return func() {}
+	}
+	mu, _ := fileLocks.LoadOrStore(key, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// modifyMessages loads the file, applies modify and writes the result back,
+// starting over when another writer changed the file in between. If modify
+// returns a nil slice, or dryRun is set, nothing is written.
+func modifyMessages(ctx context.Context, s3Key string, dryRun bool, modify func(AllMessages) (AllMessages, error)) error {
+	defer lockFile(bucketFrom(ctx) + "/" + s3Key)()
+
+	differ, canDiff := store.(diffPutter)
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		messages, meta, err := store.Get(ctx, s3Key)
+		if err != nil {
+			return fmt.Errorf("get failed: %w", err)
+		}
+		// modify edits messages in place, so keep what was read to diff against
+		var previous AllMessages
+		if canDiff {
+			previous = slices.Clone(messages)
+		}
+
+		updated, err := modify(messages)
+		if err != nil {
+			return err
+		}
+		if updated != nil {
+			noteMessageCount(ctx, len(updated))
+		} else {
+			noteMessageCount(ctx, len(messages))
+		}
+		if updated == nil || dryRun {
+			return nil
+		}
+
+		if canDiff {
+			err = differ.PutDiff(ctx, s3Key, previous, updated, meta.ETag)
+		} else {
+			err = store.Put(ctx, s3Key, updated, meta.ETag)
+		}
+		if errors.Is(err, ErrPreconditionFailed) {
+			continue
+		}
+		return err
+	}
+
+	return errConcurrentModification
+}
+
+// isTimeout covers ErrStorageTimeout and backends that return the context's
+// own error when an action's budget runs out.
+func isTimeout(err error) bool {
+	return errors.Is(err, ErrStorageTimeout) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func readError(err error) (int, interface{}) {
+	var corruptErr *CorruptFileError
+	if errors.As(err, &corruptErr) {
+		return corruptFileResponse(corruptErr)
+	}
+	if isTimeout(err) {
+		return clientError(504, "storage timeout")
+	}
+	return clientError(500, fmt.Sprintf("Get failed: %v", err))
+}
+
+func mutationError(err error) (int, interface{}) {
+	var corruptErr *CorruptFileError
+	if errors.As(err, &corruptErr) {
+		return corruptFileResponse(corruptErr)
+	}
+
+	switch {
+	case errors.Is(err, errMessageNotFound):
+		return clientError(404, "message not found")
+	case errors.Is(err, errParentNotFound):
+		return clientError(400, "parent message not found")
+	case errors.Is(err, errConcurrentModification):
+		return clientError(409, "concurrent modification")
+	case errors.Is(err, ErrFileTooLarge):
+		return clientError(413, "file too large")
+	case errors.Is(err, errFileFull):
+		return clientError(409, "file full: archive old messages or write to a new file")
+	case errors.Is(err, ErrFileNotFound):
+		return clientError(404, "file not found")
+	case errors.Is(err, ErrFileExists):
+		return clientError(409, "file already exists")
+	case errors.Is(err, ErrPreconditionFailed):
+		return clientError(409, "concurrent modification")
+	case isTimeout(err):
+		return clientError(504, "storage timeout")
+	default:
+		return clientError(500, fmt.Sprintf("Save failed: %v", err))
+	}
+}
+
+// ======================
+// ✅ Validation
+// ======================
+
+// Accepted layouts for Message.Date, tried in order
+var dateLayouts = []string{time.RFC3339, "2006-01-02"}
+
+func parseMessageDate(date string) (time.Time, error) {
+	var err error
+	for _, layout := range dateLayouts {
+		var t time.Time
+		if t, err = time.Parse(layout, date); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// parseDateRange reads get's from/to bounds; zero means unbounded. A
+// date-only to covers that whole day.
+func parseDateRange(fromValue, toValue string) (from, to time.Time, err error) {
+	if fromValue != "" {
+		if from, err = parseMessageDate(fromValue); err != nil {
+			return from, to, errors.New("invalid 'from' (RFC3339 or YYYY-MM-DD)")
+		}
+	}
+	if toValue != "" {
+		if to, err = parseMessageDate(toValue); err != nil {
+			return from, to, errors.New("invalid 'to' (RFC3339 or YYYY-MM-DD)")
+		}
+		if _, dateErr := time.Parse("2006-01-02", toValue); dateErr == nil {
+			to = to.Add(24*time.Hour - time.Nanosecond)
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && from.After(to) {
+		return from, to, errors.New("'from' is after 'to'")
+	}
+	return from, to, nil
+}
+
+// filterDateRange keeps messages dated within [from, to]. Unparseable dates
+// are dropped unless includeUndated.
+func filterDateRange(messages AllMessages, from, to time.Time, includeUndated bool) AllMessages {
+	filtered := AllMessages{}
+	for _, m := range messages {
+		date, err := parseMessageDate(m.Date)
+		if err != nil {
+			if includeUndated {
+				filtered = append(filtered, m)
+			}
+			continue
+		}
+		if (!from.IsZero() && date.Before(from)) || (!to.IsZero() && date.After(to)) {
+			continue
+		}
+		filtered = append(filtered, m)
+	}
+	return filtered
+}
+
+const maxFilenameLength = 128
+
+// Letters, digits, "_" and "-" only: no "/", "." or "..", so a filename can
+// never address a key outside its own prefix
+var filenamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func validateFilename(filename string) error {
+	if len(filename) > maxFilenameLength {
+		return fmt.Errorf("filename longer than %d characters", maxFilenameLength)
+	}
+	if !filenamePattern.MatchString(filename) {
+		return errors.New("filename may only contain letters, digits, '_' and '-'")
+	}
+	return nil
+}
+
+// Validators return a map of JSON field name → problem, or nil when valid.
+
+// validateMessage normalizes (see normalizeText) and checks a complete message
+// before it is stored.
+func validateMessage(m *Message) map[string]string {
+	fields := normalizeText(map[string]*string{
+		"sender":   &m.Sender,
+		"receiver": &m.Receiver,
+		"message":  &m.Message,
+	})
+	for name, value := range map[string]string{
+		"sender":   m.Sender,
+		"receiver": m.Receiver,
+		"message":  m.Message,
+		"date":     m.Date,
+	} {
+		if value == "" && fields[name] == "" {
+			fields[name] = "required"
+		}
+	}
+	if m.Date != "" && !isValidDate(m.Date) {
+		fields["date"] = "must be RFC3339"
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+func isValidDate(date string) bool {
+	_, err := parseMessageDate(date)
+	return err == nil
+}
+
+// validateMessageInput checks the message fields of an add or update request.
+// Add needs every field; update only validates the fields it sets.
+// Text fields are normalized in place first (see normalizeText).
+func validateMessageInput(input *APIRequest) map[string]string {
+	if input.Action == "add" {
+		m := Message{
+			Sender:   input.Sender,
+			Receiver: input.Receiver,
+			Message:  input.Message,
+			Date:     input.Date,
+		}
+		fields := validateMessage(&m)
+		input.Sender, input.Receiver, input.Message = m.Sender, m.Receiver, m.Message
+		return fields
+	}
+
+	fields := normalizeText(map[string]*string{
+		"sender":   &input.Sender,
+		"receiver": &input.Receiver,
+		"message":  &input.Message,
+	})
+	if input.Date != "" && !isValidDate(input.Date) {
+		fields["date"] = "must be RFC3339"
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// normalizeText trims leading and trailing whitespace (Unicode included) from
+// each field in place and reports fields holding control characters other
+// than tab, newline and carriage return.
+func normalizeText(values map[string]*string) map[string]string {
+	fields := map[string]string{}
+	for name, value := range values {
+		*value = strings.TrimSpace(*value)
+		if strings.ContainsFunc(*value, func(r rune) bool {
+			return unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r'
+		}) {
+			fields[name] = "must not contain control characters"
+		}
+	}
+	return fields
+}
+
+// ======================
+// 🔑 Idempotency
+// ======================
+
+// How long an idempotency key is remembered after the add that used it
+var idempotencyTTL = 24 * time.Hour
+
+func findIdempotentMessage(messages AllMessages, key string) int {
+	for i, m := range messages {
+		if m.IdempotencyKey == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// expireIdempotencyKeys clears keys past their expiry so the dedup set
+// doesn't grow forever.
+func expireIdempotencyKeys(messages AllMessages, now time.Time) {
+	for i, m := range messages {
+		if m.IdempotencyKey == "" {
+			continue
+		}
+		expires, err := time.Parse(time.RFC3339, m.IdempotencyExpires)
+		if err != nil || now.After(expires) {
+			messages[i].IdempotencyKey = ""
+			messages[i].IdempotencyExpires = ""
+		}
+	}
+}
+
+// ======================
+// 👯 Dedup
+// ======================
+
+// dedupOnAdd catches double submits from clients that send no idempotency
+// key. It runs after the key lookup above, so a replayed key always wins.
+
+// How far apart two identical adds' dates may be and still count as a
+// double submit (DEDUP_WINDOW)
+var dedupWindow = time.Minute
+
+// dedupedMessage is an add answered with an existing message.
+type dedupedMessage struct {
+	Message
+	Deduped bool `json:"deduped"`
+}
+
+func lastLiveMessage(messages AllMessages) (Message, bool) {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if !messages[i].Deleted {
+			return messages[i], true
+		}
+	}
+	return Message{}, false
+}
+
+// isDuplicate compares the fields a double submit repeats. Dates that
+// don't parse only match when identical.
+func isDuplicate(last Message, input APIRequest) bool {
+	if last.Sender != input.Sender || last.Receiver != input.Receiver || last.Message != input.Message {
+		return false
+	}
+	lastDate, err1 := parseMessageDate(last.Date)
+	date, err2 := parseMessageDate(input.Date)
+	if err1 != nil || err2 != nil {
+		return last.Date == input.Date
+	}
+	gap := date.Sub(lastDate)
+	return gap >= -dedupWindow && gap <= dedupWindow
+}
+
+// ======================
+// 🧩 Helpers
+// ======================
+
+// messageLocation matches the local Gin route for a single message.
+func messageLocation(filename, id string) string {
+	return fmt.Sprintf("/messages/%s?filename=%s", url.PathEscape(id), url.QueryEscape(filename))
+}
+
+// messagesLocation is the collection URL of a file.
+func messagesLocation(filename string) string {
+	return "/messages?filename=" + url.QueryEscape(filename)
+}
+
+func messageIDs(messages AllMessages) []int {
+	ids := make([]int, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+	return ids
+}
+
+// serverTimestamp is the CreatedAt/UpdatedAt value for a write happening now.
+func serverTimestamp() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+func maxMessageID(messages AllMessages) int {
+	maxID := 0
+	for _, m := range messages {
+		if m.ID > maxID {
+			maxID = m.ID
+		}
+	}
+	return maxID
+}
+
+// findMessageIndex returns the index of the live (not deleted) message with
+// id, or -1.
+func findMessageIndex(messages AllMessages, id int) int {
+	for i, m := range messages {
+		if m.ID == id && !m.Deleted {
+			return i
+		}
+	}
+	return -1
+}
+
+// liveMessages drops tombstoned messages.
+func liveMessages(messages AllMessages) AllMessages {
+	live := AllMessages{}
+	for _, m := range messages {
+		if !m.Deleted {
+			live = append(live, m)
+		}
 	}
+	return live
+}
 
-	bucketName = os.Getenv("S3_BUCKET_NAME")
-	if bucketName == "" {
-		log.Fatalf("❌ S3_BUCKET_NAME environment variable not set")
+// filterMessages keeps messages matching sender and receiver (case-insensitive);
+// an empty filter matches everything.
+func filterMessages(messages AllMessages, sender, receiver string) AllMessages {
+	if sender == "" && receiver == "" {
+		return messages
+	}
+
+	filtered := AllMessages{}
+	for _, m := range messages {
+		if matchesParticipants(m, sender, receiver) {
+			filtered = append(filtered, m)
+		}
 	}
+	return filtered
 }
 
-func buildS3Key(filename string) string {
-	return filename + ".json"
+func matchesParticipants(m Message, sender, receiver string) bool {
+	if sender != "" && !strings.EqualFold(m.Sender, sender) {
+		return false
+	}
+	if receiver != "" && !strings.EqualFold(m.Receiver, receiver) {
+		return false
+	}
+	return true
 }
 
-// ======================
-// 📤 S3: Get JSON
-// ======================
+// matchesQuery reports whether the body contains lowerQuery, which must
+// already be lower-cased (case-insensitive search).
+func matchesQuery(m Message, lowerQuery string) bool {
+	return strings.Contains(strings.ToLower(m.Message), lowerQuery)
+}
 
-func getS3JSON(ctx context.Context, cfg aws.Config, s3Key string) (AllMessages, error) {
-	s3Client := s3.NewFromConfig(cfg)
+// sortMessages sorts in place, breaking ties by ID. Dates that don't parse
+// are compared as strings.
+func sortMessages(messages AllMessages, sortBy, sortDir string) error {
+	var less func(a, b Message) bool
+	switch sortBy {
+	case "", "id":
+		less = func(a, b Message) bool { return a.ID < b.ID }
+	case "sender":
+		less = func(a, b Message) bool { return a.Sender < b.Sender }
+	case "createdAt":
+		// RFC3339 UTC strings sort chronologically
+		less = func(a, b Message) bool { return a.CreatedAt < b.CreatedAt }
+	case "date":
+		less = func(a, b Message) bool {
+			ta, errA := parseMessageDate(a.Date)
+			tb, errB := parseMessageDate(b.Date)
+			if errA != nil || errB != nil {
+				return a.Date < b.Date
+			}
+			return ta.Before(tb)
+		}
+	default:
+		return errors.New("sortBy must be one of: id, date, sender, createdAt")
+	}
 
-	_, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(s3Key),
-	})
-	if err != nil {
-		if isS3NotFoundErr(err) {
-			return []Message{}, nil // File not found → return empty array
+	// Ties fall back to ID so every call returns the same order
+	byField := less
+	less = func(a, b Message) bool {
+		if byField(a, b) {
+			return true
+		}
+		if byField(b, a) {
+			return false
 		}
-		return nil, fmt.Errorf("head failed: %v", err)
+		return a.ID < b.ID
 	}
 
-	resp, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(s3Key),
-	})
-	if err != nil {
-		return nil, fmt.Errorf("get failed: %v", err)
+	switch sortDir {
+	case "", "asc":
+	case "desc":
+		asc := less
+		less = func(a, b Message) bool { return asc(b, a) }
+	default:
+		return errors.New("sortDir must be asc or desc")
 	}
-	defer resp.Body.Close()
 
-	var messages AllMessages
-	if err := json.NewDecoder(resp.Body).Decode(&messages); err != nil {
-		return nil, fmt.Errorf("decode failed: %v", err)
+	sort.SliceStable(messages, func(i, j int) bool { return less(messages[i], messages[j]) })
+	return nil
+}
+
+// messagesToCSV writes a header row plus one row per message; encoding/csv
+// quotes embedded commas, quotes and newlines.
+func messagesToCSV(messages AllMessages) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	if err := w.Write([]string{"id", "sender", "receiver", "message", "date"}); err != nil {
+		return nil, err
+	}
+	for _, m := range messages {
+		row := []string{publicID(m), m.Sender, m.Receiver, m.Message, m.Date}
+		if err := w.Write(row); err != nil {
+			return nil, err
+		}
 	}
 
-	return messages, nil
+	w.Flush()
+	return buf.Bytes(), w.Error()
 }
 
-// ======================
-// 📥 S3: Save JSON
-// ======================
+// messagesToNDJSON writes one message per line; every line, including the
+// last, ends in a newline so clients can split as they read.
+func messagesToNDJSON(messages AllMessages) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf) // Encode appends the newline
+	for _, m := range messages {
+		if err := enc.Encode(publicPayload(m)); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// normalizeIDs keeps the positive IDs a client sent and numbers the rest
+// after the highest one, so a replaced file never holds duplicate IDs. Other
+// server fields are reset, with createdAt stamped now.
+func normalizeIDs(messages AllMessages) (AllMessages, error) {
+	seen := map[int]bool{}
+	for _, m := range messages {
+		if m.ID <= 0 {
+			continue
+		}
+		if seen[m.ID] {
+			return nil, fmt.Errorf("duplicate id %d", m.ID)
+		}
+		seen[m.ID] = true
+	}
 
-func putS3JSON(ctx context.Context, cfg aws.Config, s3Key string, messages AllMessages) error {
-	s3Client := s3.NewFromConfig(cfg)
+	nextID := maxMessageID(messages) + 1
+	createdAt := serverTimestamp()
+	normalized := make(AllMessages, len(messages))
+	for i, m := range messages {
+		if m.ID <= 0 {
+			m.ID = nextID
+			nextID++
+		}
+		clearServerFields(&m)
+		m.CreatedAt = createdAt
+		assignUUID(&m)
+		normalized[i] = m
+	}
+	return normalized, nil
+}
 
-	data, err := json.MarshalIndent(messages, "", "  ")
-	if err != nil {
-		return fmt.Errorf("marshal failed: %v", err)
+// invalidParents checks each batch message's parentId against the live
+// messages in parents, keyed like validation errors; nil when all resolve.
+func invalidParents(batch, parents AllMessages) map[string]string {
+	live := map[int]bool{}
+	for _, m := range parents {
+		if !m.Deleted {
+			live[m.ID] = true
+		}
 	}
+	for i, m := range batch {
+		if m.ParentID != 0 && (m.ParentID == m.ID || !live[m.ParentID]) {
+			return map[string]string{fmt.Sprintf("messages[%d].parentId", i): "parent message not found"}
+		}
+	}
+	return nil
+}
 
-	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(s3Key),
-		Body:   bytes.NewReader(data),
+// importedIDs maps the source IDs of imported messages to the IDs they get
+// from nextID on; a repeated source ID keeps its first message.
+func importedIDs(imported AllMessages, nextID int) map[int]int {
+	renumbered := map[int]int{}
+	for i, m := range imported {
+		if _, seen := renumbered[m.ID]; m.ID > 0 && !seen {
+			renumbered[m.ID] = nextID + i
+		}
+	}
+	return renumbered
+}
+
+// assignUUID gives m a random public ID when ID_STRATEGY=uuid and it has
+// none yet. Sequential mode leaves it empty so stored files are unchanged.
+func assignUUID(m *Message) {
+	if idStrategy == "uuid" && m.UUID == "" {
+		m.UUID = uuid.NewString()
+	}
+}
+
+// resolveUUID maps a public UUID to the live message's internal ID, or 0.
+func resolveUUID(ctx context.Context, s3Key, id string) (int, error) {
+	matches, err := store.Scan(ctx, s3Key, func(m Message) bool {
+		return m.UUID == id && !m.Deleted
 	})
-	if err != nil {
-		return fmt.Errorf("put failed: %v", err)
+	if err != nil || len(matches) == 0 {
+		return 0, err
+	}
+	return matches[0].ID, nil
+}
+
+// findUUIDIndex is findMessageIndex by UUID.
+func findUUIDIndex(messages AllMessages, id string) int {
+	for i, m := range messages {
+		if m.UUID == id && !m.Deleted {
+			return i
+		}
 	}
+	return -1
+}
 
+// linkParent keeps m's parentUuid in step with its parentId. A parentUuid
+// sent without a parentId picks the live message in messages with that
+// UUID; errParentNotFound when none has it. Sequential mode has no UUIDs,
+// so it stores no parentUuid either.
+func linkParent(m *Message, messages AllMessages) error {
+	if m.ParentUUID != "" && m.ParentID == 0 {
+		idx := findUUIDIndex(messages, m.ParentUUID)
+		if idx == -1 {
+			return errParentNotFound
+		}
+		m.ParentID = messages[idx].ID
+	}
+	m.ParentUUID = ""
+	if idx := findMessageIndex(messages, m.ParentID); m.ParentID != 0 && idx != -1 {
+		m.ParentUUID = messages[idx].UUID
+	}
 	return nil
 }
 
-// ======================
-// ❓ S3: Is Not Found?
-// ======================
+// linkParents links a batch whose parentIds point within the batch itself.
+// Any parentUuid sent named the source's messages, whose UUIDs are reset.
+func linkParents(batch AllMessages) {
+	for i := range batch {
+		batch[i].ParentUUID = ""
+		linkParent(&batch[i], batch)
+	}
+}
 
-func isS3NotFoundErr(err error) bool {
-	return err != nil && (err.Error() == "NotFound" || err.Error() == "no such key" || err.Error() == "s3.ErrCodeNoSuchKey")
+// linkPatchedParent is linkParent after a merge patch: whichever of
+// parentId or parentUuid the patch named wins over the other's old value.
+func linkPatchedParent(m *Message, patch map[string]interface{}, messages AllMessages) error {
+	if _, ok := patch["parentUuid"]; ok {
+		m.ParentID = 0
+	} else {
+		m.ParentUUID = ""
+	}
+	return linkParent(m, messages)
 }
 
-// ======================
-// 🧩 Gin Handlers (Normal Mode)
-// ======================
+// publicID is how clients address m: its UUID with ID_STRATEGY=uuid,
+// otherwise the sequential ID.
+func publicID(m Message) string {
+	if idStrategy == "uuid" {
+		return m.UUID
+	}
+	return strconv.Itoa(m.ID)
+}
 
-func setupGinHandlers() *gin.Engine {
-	r := gin.Default()
+func publicIDs(messages AllMessages) []string {
+	ids := make([]string, len(messages))
+	for i, m := range messages {
+		ids[i] = publicID(m)
+	}
+	return ids
+}
 
-	r.GET("/", func(c *gin.Context) {
-		c.JSON(200, gin.H{"message": "Gin + Lambda + S3 CRUD API"})
-	})
-	r.GET("/test", func(c *gin.Context) {
-		c.JSON(200, gin.H{"message": "Test Success"})
-	})
+// publicMessage is a Message as clients see it with ID_STRATEGY=uuid. The
+// shallower, always-nil ID fields win over the embedded ones and omitempty
+// drops them, so the internal sequence never reaches a response; parentUuid
+// names the parent instead.
+type publicMessage struct {
+	Message
+	ID       *int `json:"id,omitempty"`
+	ParentID *int `json:"parentId,omitempty"`
+}
 
-	// Example routes (you can expand these or use API Gateway proxy)
-	// Normally you'd use API Gateway for Lambda, but here's how you'd structure them in Gin:
-	// r.GET("/messages", getMessagesHandler)
-	// r.POST("/messages?filename=file1", addMessageHandler)
-	// etc.
+type publicDedupedMessage struct {
+	publicMessage
+	Deduped bool `json:"deduped"`
+}
 
-	return r
+// publicPayload hides internal message IDs from a response in uuid mode;
+// stored files keep them, since Message's own JSON is the storage format.
+func publicPayload(payload interface{}) interface{} {
+	if idStrategy != "uuid" {
+		return payload
+	}
+	switch p := payload.(type) {
+	case Message:
+		return publicMessage{Message: p}
+	case *Message:
+		return publicMessage{Message: *p}
+	case AllMessages:
+		return publicMessages(p)
+	case []Message:
+		return publicMessages(p)
+	case dedupedMessage:
+		return publicDedupedMessage{publicMessage: publicMessage{Message: p.Message}, Deduped: p.Deduped}
+	case APIResponse:
+		p.Data = publicPayload(p.Data)
+		return p
+	}
+	return payload
 }
 
-// ======================
-// 🧠 Lambda Handler (API Gateway Proxy)
-// ======================
+func publicMessages(messages []Message) []publicMessage {
+	out := make([]publicMessage, len(messages))
+	for i, m := range messages {
+		out[i] = publicMessage{Message: m}
+	}
+	return out
+}
 
-type APIRequest struct {
-	Action   string `json:"action"`   // "get", "add", "update", "delete"
-	Filename string `json:"filename"` // → file1.json
-	// For ADD:
-	Sender   string `json:"sender,omitempty"`
-	Receiver string `json:"receiver,omitempty"`
-	Message  string `json:"message,omitempty"`
-	Date     string `json:"date,omitempty"`
-	// For UPDATE / DELETE: you can add "id" or "index"
-	ID int `json:"id,omitempty"` // Used to update/delete specific item
+// messageFields are the JSON names a projection may ask for.
+var messageFields = func() map[string]bool {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(Message{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		fields[name] = true
+	}
+	return fields
+}()
+
+// serverFields are managed by the service and can't be patched.
+var serverFields = map[string]bool{
+	"id":                 true,
+	"deleted":            true,
+	"uuid":               true,
+	"createdAt":          true,
+	"updatedAt":          true,
+	"idempotencyKey":     true,
+	"idempotencyExpires": true,
 }
 
-type APIResponse struct {
-	Status  string      `json:"status,omitempty"`
-	Data    interface{} `json:"data,omitempty"`
-	Message string      `json:"message,omitempty"`
+// clearServerFields drops whatever a client sent for serverFields on a
+// whole message, except the ID, which each action numbers its own way.
+func clearServerFields(m *Message) {
+	m.Deleted = false
+	m.UUID = ""
+	m.CreatedAt, m.UpdatedAt = "", ""
+	m.IdempotencyKey, m.IdempotencyExpires = "", ""
 }
 
-func Handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	// Parse body
-	var input APIRequest
-	if err := json.Unmarshal([]byte(req.Body), &input); err != nil {
-		return clientError(400, "Invalid JSON body"), nil
+func validateFields(fields []string) error {
+	for _, name := range fields {
+		if !messageFields[name] {
+			return fmt.Errorf("unknown field %q", name)
+		}
 	}
+	return nil
+}
 
-	if input.Action == "" || input.Filename == "" {
-		return clientError(400, "Missing 'action' or 'filename'"), nil
+const redactionMarker = "[redacted]"
+
+// redactableFields maps Message's string fields, the only ones a marker
+// string can stand in for, to their struct index.
+var redactableFields = func() map[string]int {
+	fields := map[string]int{}
+	t := reflect.TypeOf(Message{})
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Type.Kind() == reflect.String {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			fields[name] = i
+		}
 	}
+	return fields
+}()
 
-	s3Key := "data/" + buildS3Key(input.Filename)
+func validateRedact(fields []string) error {
+	for _, name := range fields {
+		if _, ok := redactableFields[name]; !ok {
+			return fmt.Errorf("field %q can't be redacted", name)
+		}
+	}
+	return nil
+}
 
+// redactedQueryField names a field in redact that the request would list,
+// match, filter or sort on, or "". Any of those leaks the hidden values:
+// distinct lists them, search and filters confirm a guess, and sorting
+// orders by them.
+func redactedQueryField(input APIRequest, redact []string) string {
+	if len(redact) == 0 {
+		return ""
+	}
+	used := []string{}
 	switch input.Action {
-	case "get":
-		messages, err := getS3JSON(ctx, cfg, s3Key)
-		if err != nil {
-			return clientError(500, fmt.Sprintf("Get failed: %v", err)), nil
+	case "distinct":
+		used = append(used, input.Field)
+	case "search":
+		used = append(used, "message")
+	case "get", "tail", "count", "updateWhere":
+		if input.Sender != "" {
+			used = append(used, "sender")
 		}
-		return successResponse(messages), nil
-
-	case "add":
-		if input.Sender == "" || input.Receiver == "" || input.Message == "" || input.Date == "" {
-			return clientError(400, "Missing fields for add: sender, receiver, message, date"), nil
+		if input.Receiver != "" {
+			used = append(used, "receiver")
+		}
+		if input.Action == "get" {
+			if input.From != "" || input.To != "" {
+				used = append(used, "date")
+			}
+			used = append(used, input.SortBy)
+		}
+	}
+	for _, field := range used {
+		if slices.Contains(redact, field) {
+			return field
 		}
+	}
+	return ""
+}
 
-		messages, err := getS3JSON(ctx, cfg, s3Key)
-		if err != nil {
-			return clientError(500, fmt.Sprintf("Get failed: %v", err)), nil
+// redactMessages returns copies with the named non-empty fields replaced by
+// redactionMarker. Copies, since Get may hand back the cached slice.
+func redactMessages(messages AllMessages, fields []string) AllMessages {
+	if len(fields) == 0 {
+		return messages
+	}
+	redacted := make(AllMessages, len(messages))
+	for i, m := range messages {
+		v := reflect.ValueOf(&m).Elem()
+		for _, name := range fields {
+			if f := v.Field(redactableFields[name]); f.String() != "" {
+				f.SetString(redactionMarker)
+			}
 		}
+		redacted[i] = m
+	}
+	return redacted
+}
+
+// redactMessage is redactMessages for the single message a write returns.
+func redactMessage(m Message, fields []string) Message {
+	return redactMessages(AllMessages{m}, fields)[0]
+}
 
-		newID := 1
-		if len(messages) > 0 {
-			newID = messages[len(messages)-1].ID + 1
+// projectMessages keeps only the requested fields of each message, plus id
+// (uuid with ID_STRATEGY=uuid).
+func projectMessages(messages AllMessages, fields []string) []map[string]any {
+	projected := make([]map[string]any, len(messages))
+	for i, m := range messages {
+		var full map[string]any
+		b, _ := json.Marshal(publicPayload(m))
+		json.Unmarshal(b, &full)
+
+		out := map[string]any{"id": m.ID}
+		if idStrategy == "uuid" {
+			out = map[string]any{"uuid": m.UUID}
+		}
+		for _, name := range fields {
+			if v, ok := full[name]; ok {
+				out[name] = v
+			}
 		}
+		projected[i] = out
+	}
+	return projected
+}
 
-		newMsg := Message{
-			ID:       newID,
-			Sender:   input.Sender,
-			Receiver: input.Receiver,
-			Message:  input.Message,
-			Date:     input.Date,
+// threadMessages returns the message with rootID followed by every reply
+// below it, breadth first, or nil when the root doesn't exist.
+func threadMessages(messages AllMessages, rootID int) AllMessages {
+	idx := findMessageIndex(messages, rootID)
+	if idx == -1 {
+		return nil
+	}
+
+	replies := map[int]AllMessages{}
+	for _, m := range messages {
+		if m.ParentID != 0 {
+			replies[m.ParentID] = append(replies[m.ParentID], m)
 		}
+	}
 
-		messages = append(messages, newMsg)
-		if err := putS3JSON(ctx, cfg, s3Key, messages); err != nil {
-			return clientError(500, fmt.Sprintf("Save failed: %v", err)), nil
+	thread := AllMessages{messages[idx]}
+	seen := map[int]bool{rootID: true} // Upserts could create a cycle
+	for i := 0; i < len(thread); i++ {
+		for _, reply := range replies[thread[i].ID] {
+			if !seen[reply.ID] {
+				seen[reply.ID] = true
+				thread = append(thread, reply)
+			}
 		}
+	}
+	return thread
+}
 
-		return successResponse(newMsg), nil
+// Messages returned by tail when no limit is given.
+const defaultTailLimit = 50
 
-	case "update":
-		// TODO: Find message by ID and update fields
-		return clientError(501, "Update not implemented yet"), nil
+// messagesAfter keeps messages whose ID is greater than afterID.
+func messagesAfter(messages AllMessages, afterID int) AllMessages {
+	kept := AllMessages{}
+	for _, m := range messages {
+		if m.ID > afterID {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
 
-	case "delete":
-		// TODO: Find message by ID and remove it
-		return clientError(501, "Delete not implemented yet"), nil
+// nextCursor is the last public ID on an ID-ordered page, or "" when nothing
+// follows.
+func nextCursor(page AllMessages, more bool) string {
+	if !more || len(page) == 0 {
+		return ""
+	}
+	return publicID(page[len(page)-1])
+}
 
-	default:
-		return clientError(400, "Invalid action. Use: get, add, update, delete"), nil
+func paginate(messages AllMessages, offset, limit int) AllMessages {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(messages) {
+		offset = len(messages)
+	}
+
+	end := len(messages)
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
 	}
+
+	return messages[offset:end]
 }
+
 // ======================
-// 🧩 Helpers
+// 🌐 CORS
 // ======================
 
-func successResponse(data interface{}) events.APIGatewayProxyResponse {
+var corsAllowOrigin = "*"
+
+func corsHeaders() map[string]string {
+	return map[string]string{
+		"Access-Control-Allow-Origin":  corsAllowOrigin,
+		"Access-Control-Allow-Methods": "GET, POST, PUT, DELETE, OPTIONS",
+		// Every request header the API reads, plus W3C trace context
+		"Access-Control-Allow-Headers": "Content-Type, Content-Encoding, Authorization, If-None-Match, If-Modified-Since, Idempotency-Key, Accept-Version, traceparent, tracestate",
+		// Browsers hide non-safelisted response headers from scripts otherwise
+		"Access-Control-Expose-Headers": "ETag, Last-Modified, Location, Warning, Retry-After, Content-Disposition",
+	}
+}
+
+func jsonHeaders() map[string]string {
+	headers := corsHeaders()
+	headers["Content-Type"] = "application/json"
+	return headers
+}
+
+// preflightResponse answers a browser OPTIONS request.
+func preflightResponse() events.APIGatewayProxyResponse {
 	return events.APIGatewayProxyResponse{
-		StatusCode: 200,
-		Body:       toJson(data),
-		Headers:    map[string]string{"Content-Type": "application/json"},
+		StatusCode: 204,
+		Headers:    corsHeaders(),
+	}
+}
+
+// corsMiddleware gives the local Gin server the same CORS behavior as Lambda.
+func corsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for k, v := range corsHeaders() {
+			c.Header(k, v)
+		}
+		if c.Request.Method == "OPTIONS" {
+			c.AbortWithStatus(204)
+			return
+		}
+		c.Next()
+	}
+}
+
+// notModifiedResponse is an empty 304 for If-Modified-Since. It carries no
+// ETag: the only one clients see is cacheableResponse's body hash, which
+// isn't known without reading the file, and the stored object's tag would
+// never match it.
+func notModifiedResponse(meta ObjectMeta) (int, interface{}) {
+	return 304, &httpPayload{Headers: map[string]string{
+		"Last-Modified": meta.LastModified.UTC().Format(http.TimeFormat),
+	}}
+}
+
+// cacheableResponse is successResponse plus a weak ETag over the encoded
+// body. Filters and pagination change the body, so the tag is per response
+// rather than the stored object's; a matching If-None-Match gets a 304.
+func cacheableResponse(data interface{}, ifNoneMatch string) (int, interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return successResponse(data)
 	}
+	sum := sha256.Sum256(body)
+	etag := fmt.Sprintf(`W/"%x"`, sum[:16])
+
+	headers := map[string]string{"ETag": etag}
+	if etagMatches(ifNoneMatch, etag) {
+		return 304, &httpPayload{Headers: headers}
+	}
+	return 200, &httpPayload{Headers: headers, JSON: data}
+}
+
+// etagMatches applies If-None-Match's weak comparison: any listed tag equal
+// to etag once W/ prefixes are dropped, or "*".
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// dryRunResponse reports what a mutating action would have done.
+func dryRunResponse(status string, data interface{}) (int, interface{}) {
+	return successResponse(APIResponse{Status: status, Data: data, DryRun: true})
+}
+
+// healthResponse is 200 when storage is reachable and 503 otherwise.
+func healthResponse(ctx context.Context) (int, interface{}) {
+	if err := store.Ping(ctx); err != nil {
+		return clientError(503, err.Error())
+	}
+	return successResponse(APIResponse{Status: "ok"})
+}
+
+// httpPayload is a dispatch payload that needs more than a JSON body: extra
+// headers (Location, ETag) or raw bytes such as a file export.
+type httpPayload struct {
+	Headers map[string]string
+	JSON    interface{} // Encoded as the body unless Raw is set; nil → empty
+	Raw     []byte
+}
+
+// encodePayload turns a dispatch payload into response headers and body.
+// Anything other than *httpPayload is sent as JSON.
+func encodePayload(payload interface{}) (map[string]string, []byte) {
+	p, ok := payload.(*httpPayload)
+	if !ok {
+		return jsonHeaders(), []byte(toJson(stampVersion(publicPayload(payload))))
+	}
+
+	headers := corsHeaders()
+	var body []byte
+	switch {
+	case p.Raw != nil:
+		body = p.Raw
+	case p.JSON != nil:
+		headers = jsonHeaders()
+		body = []byte(toJson(stampVersion(publicPayload(p.JSON))))
+	}
+	for k, v := range p.Headers {
+		headers[k] = v
+	}
+	return headers, body
+}
+
+// stampVersion marks APIResponse envelopes with the version of their shape.
+// Only version 1 exists; a later one would reshape the envelope here.
+func stampVersion(payload interface{}) interface{} {
+	if resp, ok := payload.(APIResponse); ok {
+		resp.APIVersion = currentAPIVersion
+		return resp
+	}
+	return payload
 }
 
-func clientError(status int, msg string) events.APIGatewayProxyResponse {
+// lambdaResponse adapts a dispatch result to API Gateway. Raw bodies are
+// base64-encoded since API Gateway only passes non-JSON through that way.
+func lambdaResponse(status int, payload interface{}) events.APIGatewayProxyResponse {
+	headers, body := encodePayload(payload)
+	if p, ok := payload.(*httpPayload); ok && p.Raw != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode:      status,
+			Body:            base64.StdEncoding.EncodeToString(body),
+			IsBase64Encoded: true,
+			Headers:         headers,
+		}
+	}
 	return events.APIGatewayProxyResponse{
 		StatusCode: status,
-		Body:       toJson(map[string]string{"error": msg}),
-		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+		Headers:    headers,
+	}
+}
+
+func successResponse(data interface{}) (int, interface{}) {
+	return 200, data
+}
+
+// createdResponse answers a successful create with 201 and a Location pointing
+// at the new resource.
+func createdResponse(data interface{}, location string) (int, interface{}) {
+	return 201, &httpPayload{Headers: map[string]string{"Location": location}, JSON: data}
+}
+
+func clientError(status int, msg string) (int, interface{}) {
+	return status, map[string]string{"error": msg}
+}
+
+// parseHTTPTimestamp accepts RFC3339 (request bodies) or the HTTP date format
+// browsers send in If-Modified-Since.
+func parseHTTPTimestamp(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return http.ParseTime(value)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// binaryResponse returns a file download; lambdaResponse base64-encodes it
+// for API Gateway.
+func binaryResponse(data []byte, contentType, filename string) (int, interface{}) {
+	return 200, &httpPayload{
+		Headers: map[string]string{
+			"Content-Type":        contentType,
+			"Content-Disposition": fmt.Sprintf("attachment; filename=%q", filename),
+		},
+		Raw: data,
+	}
+}
+
+// validationError reports per-field problems, e.g. {"sender":"required"}.
+func validationError(fields map[string]string) (int, interface{}) {
+	return 400, map[string]interface{}{
+		"error":  "validation failed",
+		"fields": fields,
+	}
+}
+
+func corruptFileResponse(e *CorruptFileError) (int, interface{}) {
+	return 422, map[string]interface{}{
+		"error":       "stored file is corrupt",
+		"offset":      e.Offset,
+		"quarantined": e.Quarantined,
 	}
 }
 
@@ -257,7 +4198,13 @@ func toJson(v interface{}) string {
 	return string(b)
 }
 
-var cfg aws.Config
+var (
+	cfg aws.Config
+
+	// Built once in main and shared: the client is safe for concurrent use
+	// and reusing it keeps warm invocations off the setup path.
+	s3Client *s3.Client
+)
 
 func main() {
 	var err error
@@ -265,6 +4212,21 @@ func main() {
 	if err != nil {
 		log.Fatalf("❌ AWS config error: %v", err)
 	}
+	cfg.APIOptions = append(cfg.APIOptions, timeStorageCalls)
+	s3Client = newS3Client(cfg)
+	log.Printf("🌍 S3 region: %s", s3Client.Options().Region)
+	switch storeBackend {
+	case "dynamodb":
+		store = NewDynamoStore(dynamodb.NewFromConfig(cfg), dynamoTable)
+	default:
+		s3Store := NewS3Store(s3Client)
+		if s3FailoverRegion != "" {
+			s3Store.failover = newS3Client(cfg, func(o *s3.Options) { o.Region = s3FailoverRegion })
+			log.Printf("🛟 S3 read failover: %s", s3FailoverRegion)
+		}
+		store = s3Store
+	}
+	initTracing(context.Background())
 
 	// ✅ Detect: running on Lambda or locally?
 	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != "" {
@@ -272,7 +4234,47 @@ func main() {
 		lambda.Start(Handler)
 	} else {
 		// Local mode: run Gin HTTP server
-		r := setupGinHandlers()
-		r.Run(":8080")
+		localMode = true
+		serveLocal(setupGinHandlers(), listenAddr)
+	}
+}
+
+// Address the local Gin server listens on (LISTEN_ADDR)
+var listenAddr = ":8080"
+
+// How long in-flight requests get to finish after SIGINT/SIGTERM
+const shutdownTimeout = 10 * time.Second
+
+// serveLocal runs the Gin server until SIGINT or SIGTERM, then stops taking
+// connections and lets in-flight requests (and their S3 writes) finish.
+func serveLocal(handler http.Handler, addr string) {
+	srv := &http.Server{Addr: addr, Handler: handler}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("🚀 Listening on %s", addr)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("❌ Server error: %v", err)
+		}
+		return
+	case <-ctx.Done():
+	}
+	stop() // A second signal kills the process immediately
+
+	log.Printf("🛑 Shutting down, draining requests for up to %s", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("⚠️ Shutdown incomplete: %v", err)
 	}
-}
\ No newline at end of file
+	flushTraces(shutdownCtx)
+	log.Printf("👋 Server stopped")
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestIsS3NotFoundErr(t *testing.T) {
+	// The SDK wraps service errors in an OperationError before returning them
+	wrap := func(err error) error {
+		return fmt.Errorf("head failed: %w", &smithy.OperationError{
+			ServiceID:     "S3",
+			OperationName: "HeadObject",
+			Err:           err,
+		})
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"generic NotFound", wrap(&smithy.GenericAPIError{Code: "NotFound"}), true},
+		{"generic NoSuchKey", wrap(&smithy.GenericAPIError{Code: "NoSuchKey"}), true},
+		{"typed NotFound", wrap(&types.NotFound{}), true},
+		{"typed NoSuchKey", wrap(&types.NoSuchKey{}), true},
+		{"access denied", wrap(&smithy.GenericAPIError{Code: "AccessDenied"}), false},
+		{"plain error", errors.New("boom"), false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		if got := isS3NotFoundErr(tt.err); got != tt.want {
+			t.Errorf("%s: isS3NotFoundErr = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGzipRoundTrip(t *testing.T) {
+	body := []byte(`[{"id":1,"message":"hi"}]`)
+	compressed, err := gzipBytes(body)
+	if err != nil {
+		t.Fatalf("gzipBytes: %v", err)
+	}
+
+	// Magic-byte detection must work even when the header was lost
+	for _, encoding := range []string{"gzip", ""} {
+		r, err := decompressBody(bytes.NewReader(compressed), encoding)
+		if err != nil {
+			t.Fatalf("decompressBody(%q): %v", encoding, err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("read(%q): %v", encoding, err)
+		}
+		if !bytes.Equal(got, body) {
+			t.Errorf("decompressBody(%q) = %s, want %s", encoding, got, body)
+		}
+	}
+}
+
+func TestDecompressBodyLegacyPlain(t *testing.T) {
+	body := []byte(`[{"id":1,"message":"hi"}]`)
+	r, err := decompressBody(bytes.NewReader(body), "")
+	if err != nil {
+		t.Fatalf("decompressBody: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("decompressBody = %s, want %s", got, body)
+	}
+}
+
+func TestApplyServerSideEncryption(t *testing.T) {
+	defer func(sse, keyID string) { s3SSE, s3KMSKeyID = sse, keyID }(s3SSE, s3KMSKeyID)
+	s3SSE, s3KMSKeyID = string(types.ServerSideEncryptionAwsKms), "alias/messages"
+
+	input := &s3.PutObjectInput{}
+	applyServerSideEncryption(input)
+	if input.ServerSideEncryption != types.ServerSideEncryptionAwsKms {
+		t.Errorf("ServerSideEncryption = %q, want %q", input.ServerSideEncryption, types.ServerSideEncryptionAwsKms)
+	}
+	if got := aws.ToString(input.SSEKMSKeyId); got != "alias/messages" {
+		t.Errorf("SSEKMSKeyId = %q, want alias/messages", got)
+	}
+
+	// Unset keeps the bucket default
+	s3SSE, s3KMSKeyID = "", ""
+	input = &s3.PutObjectInput{}
+	applyServerSideEncryption(input)
+	if input.ServerSideEncryption != "" || input.SSEKMSKeyId != nil {
+		t.Errorf("unset SSE still set %q / %v", input.ServerSideEncryption, input.SSEKMSKeyId)
+	}
+}
+
+func TestMaxMessageID(t *testing.T) {
+	// Upserts and imports can leave the highest ID anywhere in the file
+	messages := AllMessages{{ID: 3}, {ID: 9, Deleted: true}, {ID: 5}}
+	if got := maxMessageID(messages); got != 9 {
+		t.Errorf("maxMessageID = %d, want 9", got)
+	}
+	if got := maxMessageID(AllMessages{}); got != 0 {
+		t.Errorf("maxMessageID(empty) = %d, want 0", got)
+	}
+}
+
+func TestSortMessagesTiesBreakByID(t *testing.T) {
+	ids := func(messages AllMessages) []int {
+		out := make([]int, len(messages))
+		for i, m := range messages {
+			out[i] = m.ID
+		}
+		return out
+	}
+
+	tests := []struct {
+		sortDir string
+		want    []int
+	}{
+		{"asc", []int{2, 4, 1, 3}},
+		{"desc", []int{3, 1, 4, 2}},
+	}
+	for _, tt := range tests {
+		// Same senders in different input orders must sort identically
+		for _, messages := range []AllMessages{
+			{{ID: 3, Sender: "bob"}, {ID: 4, Sender: "alice"}, {ID: 1, Sender: "bob"}, {ID: 2, Sender: "alice"}},
+			{{ID: 1, Sender: "bob"}, {ID: 2, Sender: "alice"}, {ID: 3, Sender: "bob"}, {ID: 4, Sender: "alice"}},
+		} {
+			if err := sortMessages(messages, "sender", tt.sortDir); err != nil {
+				t.Fatalf("sortMessages: %v", err)
+			}
+			if got := ids(messages); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("sortDir %s: order = %v, want %v", tt.sortDir, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(rateLimitMiddleware(1, 2))
+	r.GET("/", func(c *gin.Context) { c.Status(200) })
+
+	codes := []int{}
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "203.0.113.7:1234"
+		r.ServeHTTP(w, req)
+		codes = append(codes, w.Code)
+	}
+	if fmt.Sprint(codes) != "[200 200 429]" {
+		t.Errorf("codes past burst = %v, want [200 200 429]", codes)
+	}
+
+	// Another client has its own bucket
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	r.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Errorf("second client = %d, want 200", w.Code)
+	}
+}
+
+func TestIPLimiterEvictsIdle(t *testing.T) {
+	l := newIPLimiter(1, 2)
+	l.allow("203.0.113.7")
+	l.limiters["203.0.113.7"].lastSeen = time.Now().Add(-l.idleTTL)
+	l.lastSweep = time.Now().Add(-l.idleTTL)
+
+	l.allow("198.51.100.1")
+	if _, ok := l.limiters["203.0.113.7"]; ok {
+		t.Error("idle bucket wasn't evicted")
+	}
+	if len(l.limiters) != 1 {
+		t.Errorf("limiters = %d, want 1", len(l.limiters))
+	}
+}
+
+func TestMessagesToNDJSON(t *testing.T) {
+	data, err := messagesToNDJSON(AllMessages{{ID: 1, Message: "a"}, {ID: 2, Message: "b"}})
+	if err != nil {
+		t.Fatalf("messagesToNDJSON: %v", err)
+	}
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		t.Errorf("last line has no trailing newline: %q", data)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 2 {
+		t.Errorf("lines = %d, want 2", lines)
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	defer func(p map[string]map[string]bool) { rolePermissions = p }(rolePermissions)
+	rolePermissions = map[string]map[string]bool{
+		"reader": {"get": true, "list": true},
+		"admin":  {"*": true},
+	}
+
+	tests := []struct {
+		role, action string
+		want         bool
+	}{
+		{"reader", "get", true},
+		{"reader", "add", false},
+		{"admin", "add", true},
+		{"stranger", "get", false},
+		{"", "get", false}, // default role isn't configured
+	}
+	for _, tt := range tests {
+		if got := allowed(tt.role, tt.action); got != tt.want {
+			t.Errorf("allowed(%q, %q) = %v, want %v", tt.role, tt.action, got, tt.want)
+		}
+	}
+}
+
+func TestHandlerForbidsReadOnlyRole(t *testing.T) {
+	defer func(secret string, p map[string]map[string]bool) {
+		jwtSecret, rolePermissions = secret, p
+	}(jwtSecret, rolePermissions)
+	jwtSecret = "test-secret"
+	rolePermissions = map[string]map[string]bool{"reader": {"get": true}}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":  "user-1",
+		"role": "reader",
+	}).SignedString([]byte(jwtSecret))
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+
+	resp, err := Handler(context.Background(), events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Headers: map[string]string{
+			"Authorization": "Bearer " + token,
+			"Content-Type":  "application/json",
+		},
+		Body: `{"action":"add","filename":"chat","sender":"a","receiver":"b","message":"hi","date":"2024-01-01"}`,
+	})
+	if err != nil {
+		t.Fatalf("Handler: %v", err)
+	}
+	if resp.StatusCode != 403 {
+		t.Errorf("status = %d, want 403 (body %s)", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestPublicPayloadHidesIDInUUIDMode(t *testing.T) {
+	defer func(strategy string) { idStrategy = strategy }(idStrategy)
+	idStrategy = "uuid"
+
+	msg := Message{ID: 42, Sender: "a", UUID: "0b9c6f5e-3f4c-4a7a-9d3e-1f2a3b4c5d6e"}
+	body, err := json.Marshal(publicPayload(APIResponse{Status: "ok", Data: AllMessages{msg}}))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if strings.Contains(string(body), `"id"`) {
+		t.Errorf("internal id leaked: %s", body)
+	}
+	if !strings.Contains(string(body), msg.UUID) {
+		t.Errorf("uuid missing: %s", body)
+	}
+	if got := messageLocation("chat", publicID(msg)); got != "/messages/"+msg.UUID+"?filename=chat" {
+		t.Errorf("location = %s", got)
+	}
+}
+
+func TestDispatchAddGetMemoryStore(t *testing.T) {
+	defer func(s Store) { store = s }(store)
+	store = NewMemoryStore()
+	ctx := context.Background()
+
+	status, _ := dispatch(ctx, APIRequest{Action: "add", Filename: "chat", Sender: "a", Receiver: "b", Message: "hi", Date: "2024-01-01"})
+	if status != 201 {
+		t.Fatalf("add status = %d, want 201", status)
+	}
+
+	status, payload := dispatch(ctx, APIRequest{Action: "get", Filename: "chat"})
+	if status != 200 {
+		t.Fatalf("get status = %d, want 200", status)
+	}
+	_, body := encodePayload(payload)
+	var resp struct {
+		Data  AllMessages `json:"data"`
+		Total int         `json:"total"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.Total != 1 || len(resp.Data) != 1 || resp.Data[0].Message != "hi" {
+		t.Errorf("get = %s", body)
+	}
+}
+
+func TestGinRoutesRequireAuth(t *testing.T) {
+	defer func(secret string, p map[string]map[string]bool, s Store) {
+		jwtSecret, rolePermissions, store = secret, p, s
+	}(jwtSecret, rolePermissions, store)
+	jwtSecret = "test-secret"
+	rolePermissions = map[string]map[string]bool{"reader": {"get": true}}
+	store = NewMemoryStore()
+	gin.SetMode(gin.TestMode)
+	r := setupGinHandlers()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":  "user-1",
+		"role": "reader",
+	}).SignedString([]byte(jwtSecret))
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+
+	body := `{"sender":"a","receiver":"b","message":"hi","date":"2024-01-01"}`
+	tests := []struct {
+		name, method, auth string
+		want               int
+	}{
+		{"no token", http.MethodGet, "", 401},
+		{"reader get", http.MethodGet, "Bearer " + token, 200},
+		{"reader add", http.MethodPost, "Bearer " + token, 403},
+	}
+	for _, tt := range tests {
+		var reqBody io.Reader
+		if tt.method == http.MethodPost {
+			reqBody = strings.NewReader(body)
+		}
+		req := httptest.NewRequest(tt.method, "/messages?filename=chat", reqBody)
+		req.RemoteAddr = "203.0.113.9:1234"
+		req.Header.Set("Content-Type", "application/json")
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d (body %s)", tt.name, w.Code, tt.want, w.Body)
+		}
+	}
+}
+
+func TestWriteResponsesAreRedacted(t *testing.T) {
+	defer func(s Store, r map[string][]string) { store, roleRedactions = s, r }(store, roleRedactions)
+	store = NewMemoryStore()
+	roleRedactions = map[string][]string{"support": {"message"}}
+	ctx := withRole(context.Background(), "support")
+
+	for _, input := range []APIRequest{
+		{Action: "add", Filename: "chat", Sender: "a", Receiver: "b", Message: "secret", Date: "2024-01-01"},
+		{Action: "update", Filename: "chat", ID: 1, Message: "still secret"},
+		{Action: "patch", Filename: "chat", ID: 1, Patch: json.RawMessage(`{"message":"patched secret"}`)},
+	} {
+		status, payload := dispatch(ctx, input)
+		_, body := encodePayload(payload)
+		if status >= 300 {
+			t.Fatalf("%s status = %d: %s", input.Action, status, body)
+		}
+		if strings.Contains(string(body), "secret") {
+			t.Errorf("%s leaked a redacted field: %s", input.Action, body)
+		}
+	}
+}
+
+func TestPartitionRejectsOtherDays(t *testing.T) {
+	defer func(s Store, p bool) { store, partitionByDate = s, p }(store, partitionByDate)
+	store = NewMemoryStore()
+	partitionByDate = true
+	ctx := context.Background()
+
+	status, _ := dispatch(ctx, APIRequest{Action: "addMany", Filename: "chat", Partition: "2024-01-01", Messages: AllMessages{
+		{Sender: "a", Receiver: "b", Message: "hi", Date: "2024-01-01"},
+		{Sender: "a", Receiver: "b", Message: "later", Date: "2024-01-02"},
+	}})
+	if status != 400 {
+		t.Errorf("addMany across days = %d, want 400", status)
+	}
+
+	if status, _ := dispatch(ctx, APIRequest{Action: "add", Filename: "chat", Sender: "a", Receiver: "b", Message: "hi", Date: "2024-01-01"}); status != 201 {
+		t.Fatalf("add = %d, want 201", status)
+	}
+	status, _ = dispatch(ctx, APIRequest{Action: "patch", Filename: "chat", Partition: "2024-01-01", ID: 1, Patch: json.RawMessage(`{"date":"2024-01-02"}`)})
+	if status != 400 {
+		t.Errorf("patch to another day = %d, want 400", status)
+	}
+}
+
+func TestUUIDModeParentsAndDeleteMany(t *testing.T) {
+	defer func(s Store, strategy string) { store, idStrategy = s, strategy }(store, idStrategy)
+	store = NewMemoryStore()
+	idStrategy = "uuid"
+	ctx := context.Background()
+
+	add := func(input APIRequest) Message {
+		input.Action, input.Filename = "add", "chat"
+		input.Sender, input.Receiver, input.Message, input.Date = "a", "b", "hi", "2024-01-01"
+		status, payload := dispatch(ctx, input)
+		_, body := encodePayload(payload)
+		if status != 201 {
+			t.Fatalf("add = %d: %s", status, body)
+		}
+		if strings.Contains(string(body), `"id"`) || strings.Contains(string(body), `"parentId"`) {
+			t.Errorf("internal id leaked: %s", body)
+		}
+		var m Message
+		json.Unmarshal(body, &m)
+		return m
+	}
+
+	parent := add(APIRequest{})
+	reply := add(APIRequest{ParentUUID: parent.UUID})
+	if reply.ParentUUID != parent.UUID {
+		t.Errorf("reply parentUuid = %q, want %q", reply.ParentUUID, parent.UUID)
+	}
+	if status, _ := dispatch(ctx, APIRequest{Action: "add", Filename: "chat", Sender: "a", Receiver: "b", Message: "hi", Date: "2024-01-01", ParentUUID: "missing"}); status == 201 {
+		t.Error("unknown parentUuid was accepted")
+	}
+
+	status, payload := dispatch(ctx, APIRequest{Action: "deleteMany", Filename: "chat", UUIDs: []string{reply.UUID, "missing"}})
+	_, body := encodePayload(payload)
+	if status != 200 {
+		t.Fatalf("deleteMany = %d: %s", status, body)
+	}
+	want := fmt.Sprintf(`"deleted":["%s"],"notFound":["missing"]`, reply.UUID)
+	if !strings.Contains(string(body), want) {
+		t.Errorf("deleteMany = %s, want %s", body, want)
+	}
+}
+
+func TestMetricActionBoundsLabels(t *testing.T) {
+	for action, want := range map[string]string{
+		"get":         "get",
+		"deleteMany":  "deleteMany",
+		"preflight":   "preflight",
+		"":            "invalid",
+		"dropTables1": "invalid",
+	} {
+		if got := metricAction(action); got != want {
+			t.Errorf("metricAction(%q) = %q, want %q", action, got, want)
+		}
+	}
+}
+
+func TestDynamoErrMapsDeadlineToTimeout(t *testing.T) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if err := dynamoErr(ctx, "query", errors.New("request canceled")); !isTimeout(err) {
+		t.Errorf("expired deadline: isTimeout(%v) = false", err)
+	}
+	if err := dynamoErr(context.Background(), "query", context.DeadlineExceeded); !isTimeout(err) {
+		t.Errorf("wrapped deadline: isTimeout(%v) = false", err)
+	}
+	if err := dynamoErr(context.Background(), "query", errors.New("throttled")); isTimeout(err) {
+		t.Errorf("isTimeout(%v) = true", err)
+	}
+}
+
+// diffStore records what modifyMessages hands PutDiff.
+type diffStore struct {
+	*MemoryStore
+	previous AllMessages
+}
+
+func (d *diffStore) PutDiff(ctx context.Context, key string, previous, messages AllMessages, version string) error {
+	d.previous = previous
+	return d.Put(ctx, key, messages, version)
+}
+
+func TestModifyMessagesDiffsAgainstRead(t *testing.T) {
+	defer func(s Store) { store = s }(store)
+	ds := &diffStore{MemoryStore: NewMemoryStore()}
+	store = ds
+	ctx := context.Background()
+
+	if status, _ := dispatch(ctx, APIRequest{Action: "add", Filename: "chat", Sender: "a", Receiver: "b", Message: "hi", Date: "2024-01-01"}); status != 201 {
+		t.Fatalf("add = %d, want 201", status)
+	}
+	if status, _ := dispatch(ctx, APIRequest{Action: "update", Filename: "chat", ID: 1, Message: "edited"}); status != 200 {
+		t.Fatalf("update = %d, want 200", status)
+	}
+	// The in-place edit mustn't reach the snapshot, or the diff sees no change
+	if len(ds.previous) != 1 || ds.previous[0].Message != "hi" {
+		t.Errorf("previous = %+v, want the message as read", ds.previous)
+	}
+}
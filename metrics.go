@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/smithy-go/middleware"
+)
+
+// ======================
+// 📈 CloudWatch Metrics (EMF)
+// ======================
+
+// Lines written in the embedded metric format are turned into CloudWatch
+// metrics by the Lambda log pipeline, so no PutMetricData call is needed.
+var metricsOut io.Writer = os.Stdout
+
+func metricsNamespace() string {
+	if ns := os.Getenv("METRICS_NAMESPACE"); ns != "" {
+		return ns
+	}
+	return "S3JsonLambda"
+}
+
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+type emfRecord struct {
+	AWS      emfMetadata `json:"_aws"`
+	Action   string      `json:"Action"`
+	Count    int         `json:"Count"`
+	Errors   int         `json:"Errors"`
+	Duration float64     `json:"Duration"`
+}
+
+// metricAction bounds the Action dimension to real actions (and preflight);
+// anything else a client sends is counted as "invalid" rather than minting
+// a new metric series.
+func metricAction(action string) string {
+	if writeActions[action] || readActions[action] || action == "preflight" {
+		return action
+	}
+	return "invalid"
+}
+
+// recordMetric emits one EMF line for an invocation of action; dur is the
+// time spent waiting on storage (see storageTime).
+func recordMetric(action string, dur time.Duration, err error) {
+	action = metricAction(action)
+
+	record := emfRecord{
+		AWS: emfMetadata{
+			Timestamp: time.Now().UnixMilli(),
+			CloudWatchMetrics: []emfDirective{{
+				Namespace:  metricsNamespace(),
+				Dimensions: [][]string{{"Action"}},
+				Metrics: []emfMetric{
+					{Name: "Count", Unit: "Count"},
+					{Name: "Errors", Unit: "Count"},
+					{Name: "Duration", Unit: "Milliseconds"},
+				},
+			}},
+		},
+		Action:   action,
+		Count:    1,
+		Duration: float64(dur.Microseconds()) / 1000,
+	}
+	if err != nil {
+		record.Errors = 1
+	}
+
+	line, mErr := json.Marshal(record)
+	if mErr != nil {
+		slog.Error("metric marshal failed", "error", mErr)
+		return
+	}
+	metricsOut.Write(append(line, '\n'))
+}
+
+// ======================
+// ⏱️ Storage Timing
+// ======================
+
+type storageTimeKey struct{}
+
+// withStorageTimer starts adding up the time ctx's storage calls take.
+func withStorageTimer(ctx context.Context) context.Context {
+	return context.WithValue(ctx, storageTimeKey{}, new(atomic.Int64))
+}
+
+// storageTime is the total so far, or zero without withStorageTimer.
+func storageTime(ctx context.Context) time.Duration {
+	if total, ok := ctx.Value(storageTimeKey{}).(*atomic.Int64); ok {
+		return time.Duration(total.Load())
+	}
+	return 0
+}
+
+// timeStorageCalls is an AWS SDK option that adds each S3 and DynamoDB round
+// trip, retries included, to the calling request's storage timer.
+func timeStorageCalls(stack *middleware.Stack) error {
+	return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("StorageTimer", func(
+		ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler,
+	) (middleware.FinalizeOutput, middleware.Metadata, error) {
+		start := time.Now()
+		out, md, err := next.HandleFinalize(ctx, in)
+		if total, ok := ctx.Value(storageTimeKey{}).(*atomic.Int64); ok {
+			total.Add(int64(time.Since(start)))
+		}
+		return out, md, err
+	}), middleware.Before)
+}
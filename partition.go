@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ======================
+// 📅 Date Partitions
+// ======================
+
+// PARTITION_BY_DATE=true stores a file as one object per message day,
+// <filename>/<YYYY-MM-DD>.json, so a busy chat never funnels every write
+// through one ever-growing object. The flat <filename>.json stays default.
+//
+// Reads merge: get lists the file's partitions, loads the days inside
+// from/to (all of them without a range) and filters, sorts and pages the
+// combined messages as if they were one file. Adds go to their message's
+// day. IDs are only unique within a partition, so other actions address a
+// single day with "partition", and may only write messages dated that day.
+var partitionByDate bool
+
+const partitionLayout = "2006-01-02"
+
+// Actions that can't be scoped to one partition
+var unpartitionedActions = map[string]bool{
+	"rename":  true,
+	"archive": true,
+}
+
+func buildPartitionKey(owner, filename, day string) string {
+	return ownerPrefix(owner) + filename + "/" + day + ".json"
+}
+
+// partitionFromKey reverses dataPrefix + buildPartitionKey for owner.
+func partitionFromKey(key, owner string) (filename, day string, ok bool) {
+	prefix := dataPrefix + ownerPrefix(owner)
+	if !strings.HasPrefix(key, prefix) || !strings.HasSuffix(key, ".json") {
+		return "", "", false
+	}
+	filename, day, found := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(key, prefix), ".json"), "/")
+	if !found || validateFilename(filename) != nil {
+		return "", "", false
+	}
+	if _, err := time.Parse(partitionLayout, day); err != nil {
+		return "", "", false
+	}
+	return filename, day, true
+}
+
+// partitionedKey is the object a single-partition action works on: an add
+// goes to its message's UTC day, anything else names the day itself.
+func partitionedKey(owner string, input APIRequest) (string, error) {
+	if unpartitionedActions[input.Action] {
+		return "", fmt.Errorf("%s isn't supported with PARTITION_BY_DATE", input.Action)
+	}
+
+	if input.Action == "add" {
+		date, err := parseMessageDate(input.Date)
+		if err != nil {
+			return "", errors.New("add needs a valid 'date' (RFC3339 or YYYY-MM-DD) to pick its partition")
+		}
+		return dataPrefix + buildPartitionKey(owner, input.Filename, date.UTC().Format(partitionLayout)), nil
+	}
+
+	if _, err := time.Parse(partitionLayout, input.Partition); err != nil {
+		return "", fmt.Errorf("%s needs 'partition' (YYYY-MM-DD) with PARTITION_BY_DATE", input.Action)
+	}
+	return dataPrefix + buildPartitionKey(owner, input.Filename, input.Partition), nil
+}
+
+// partitionDateFields reports the dates a single-partition write would put
+// outside its partition, keyed like validationError's fields. Moving a
+// message to another day would mean writing a second object, so it's
+// refused rather than stored under the wrong day.
+func partitionDateFields(input APIRequest) map[string]string {
+	switch input.Action {
+	case "upsert", "update":
+		if !inPartition(input.Date, input.Partition) {
+			return map[string]string{"date": "must fall on partition " + input.Partition}
+		}
+	case "patch", "updateWhere":
+		var patch struct {
+			Date *string `json:"date"`
+		}
+		if json.Unmarshal(input.Patch, &patch) == nil && patch.Date != nil && !inPartition(*patch.Date, input.Partition) {
+			return map[string]string{"date": "must fall on partition " + input.Partition}
+		}
+	case "addMany", "replace", "createFile":
+		return datesOutsidePartition(input.Messages, input.Partition)
+	}
+	return nil
+}
+
+// datesOutsidePartition reports each message not dated on day.
+func datesOutsidePartition(messages AllMessages, day string) map[string]string {
+	fields := map[string]string{}
+	for i, m := range messages {
+		if !inPartition(m.Date, day) {
+			fields[fmt.Sprintf("messages[%d].date", i)] = "must fall on partition " + day
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// inPartition reports whether date's UTC day is day. Missing and invalid
+// dates pass; message validation reports those.
+func inPartition(date, day string) bool {
+	t, err := parseMessageDate(date)
+	return date == "" || err != nil || t.UTC().Format(partitionLayout) == day
+}
+
+// listPartitions returns the days stored for filename within [from, to],
+// oldest first; zero bounds are open.
+func listPartitions(ctx context.Context, owner, filename string, from, to time.Time) ([]string, error) {
+	objects, err := store.List(ctx, dataPrefix+ownerPrefix(owner)+filename+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	days := []string{}
+	for _, obj := range objects {
+		name, day, ok := partitionFromKey(obj.Key, owner)
+		if !ok || name != filename {
+			continue
+		}
+		// Day strings sort chronologically
+		if (!from.IsZero() && day < from.UTC().Format(partitionLayout)) || (!to.IsZero() && day > to.UTC().Format(partitionLayout)) {
+			continue
+		}
+		days = append(days, day)
+	}
+	return days, nil
+}
+
+// getPartitioned is get across the partitions in the requested range.
+func getPartitioned(ctx context.Context, owner string, input APIRequest) (int, interface{}) {
+	if input.AfterID > 0 || input.AfterUUID != "" {
+		return clientError(400, "afterId isn't supported across partitions; page with offset or name a partition")
+	}
+	from, to, err := parseDateRange(input.From, input.To)
+	if err != nil {
+		return clientError(400, err.Error())
+	}
+	if err := validateFields(input.Fields); err != nil {
+		return clientError(400, err.Error())
+	}
+
+	days, err := listPartitions(ctx, owner, input.Filename, from, to)
+	if err != nil {
+		return readError(err)
+	}
+
+	messages := AllMessages{}
+	for _, day := range days {
+		part, _, err := store.Get(ctx, dataPrefix+buildPartitionKey(owner, input.Filename, day))
+		if err != nil {
+			return readError(err)
+		}
+		messages = append(messages, part...)
+	}
+
+	if !input.IncludeDeleted {
+		messages = liveMessages(messages)
+	}
+	messages = filterMessages(messages, input.Sender, input.Receiver)
+	if !from.IsZero() || !to.IsZero() {
+		messages = filterDateRange(messages, from, to, input.IncludeUndated)
+	}
+	// IDs repeat across days, so date order is the only meaningful default
+	sortBy := firstNonEmpty(input.SortBy, "date")
+	if err := sortMessages(messages, sortBy, input.SortDir); err != nil {
+		return clientError(400, err.Error())
+	}
+
+	page := redactMessages(paginate(messages, input.Offset, input.Limit), redactionsFor(ctx, input.Redact))
+	var data interface{} = page
+	if len(input.Fields) > 0 {
+		data = projectMessages(page, input.Fields)
+	}
+	exists := len(days) > 0
+	return cacheableResponse(APIResponse{
+		Status: "ok",
+		Data:   data,
+		Total:  len(messages),
+		Exists: &exists,
+	}, input.IfNoneMatch)
+}
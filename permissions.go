@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+// ======================
+// 🛂 Permissions
+// ======================
+
+var (
+	// Actions each role may perform, e.g. {"reader": ["get", "list"],
+	// "admin": ["*"]}, from PERMISSIONS (inline JSON) or PERMISSIONS_FILE.
+	// nil means every authenticated caller may do everything.
+	rolePermissions map[string]map[string]bool
+	// JWT claim naming the caller's role (ROLE_CLAIM); tokens without it get
+	// defaultRole
+	roleClaim = "role"
+)
+
+const defaultRole = "default"
+
+func loadPermissionConfig() {
+	if claim := os.Getenv("ROLE_CLAIM"); claim != "" {
+		roleClaim = claim
+	}
+
+	loadRoleRedactions()
+
+	raw := []byte(os.Getenv("PERMISSIONS"))
+	if path := os.Getenv("PERMISSIONS_FILE"); path != "" {
+		if len(raw) > 0 {
+			log.Fatalf("❌ Set only one of PERMISSIONS and PERMISSIONS_FILE")
+		}
+		var err error
+		if raw, err = os.ReadFile(path); err != nil {
+			log.Fatalf("❌ PERMISSIONS_FILE read failed: %v", err)
+		}
+	}
+	if len(raw) == 0 {
+		return
+	}
+	// Roles come from the token, so without auth nothing could be enforced
+	if jwtSecret == "" {
+		log.Fatalf("❌ PERMISSIONS requires JWT_SECRET")
+	}
+
+	var roles map[string][]string
+	if err := json.Unmarshal(raw, &roles); err != nil {
+		log.Fatalf("❌ PERMISSIONS must map roles to action lists: %v", err)
+	}
+	rolePermissions = map[string]map[string]bool{}
+	for role, actions := range roles {
+		rolePermissions[role] = map[string]bool{}
+		for _, action := range actions {
+			rolePermissions[role][action] = true
+		}
+	}
+}
+
+type roleKey struct{}
+
+func withRole(ctx context.Context, role string) context.Context {
+	return context.WithValue(ctx, roleKey{}, role)
+}
+
+// roleFrom returns the caller's role claim, or "" without auth.
+func roleFrom(ctx context.Context) string {
+	role, _ := ctx.Value(roleKey{}).(string)
+	return role
+}
+
+// allowed reports whether role may perform action. Unknown roles get
+// nothing; "*" grants every action.
+func allowed(role, action string) bool {
+	if rolePermissions == nil {
+		return true
+	}
+	if role == "" {
+		role = defaultRole
+	}
+	actions := rolePermissions[role]
+	return actions["*"] || actions[action]
+}
+
+// checkAllowed is the 403 for a caller whose role may not perform action;
+// ok when it may.
+func checkAllowed(ctx context.Context, action string) (status int, payload interface{}, ok bool) {
+	if allowed(roleFrom(ctx), action) {
+		return 0, nil, true
+	}
+	loggerFrom(ctx).Info("forbidden", "action", action)
+	status, payload = clientError(403, fmt.Sprintf("role may not perform %q", action))
+	return status, payload, false
+}
+
+// ======================
+// 🙈 Role Redactions
+// ======================
+
+// Message fields hidden from each role on read, e.g. {"support": ["message"]}
+// (ROLE_REDACTIONS); added to whatever a request asks to redact itself.
+var roleRedactions map[string][]string
+
+func loadRoleRedactions() {
+	raw := os.Getenv("ROLE_REDACTIONS")
+	if raw == "" {
+		return
+	}
+	if jwtSecret == "" {
+		log.Fatalf("❌ ROLE_REDACTIONS requires JWT_SECRET")
+	}
+	if err := json.Unmarshal([]byte(raw), &roleRedactions); err != nil {
+		log.Fatalf("❌ ROLE_REDACTIONS must map roles to field lists: %v", err)
+	}
+	for role, fields := range roleRedactions {
+		if err := validateRedact(fields); err != nil {
+			log.Fatalf("❌ ROLE_REDACTIONS[%s]: %v", role, err)
+		}
+	}
+}
+
+// redactionsFor merges the request's redact list with the caller's role's.
+func redactionsFor(ctx context.Context, requested []string) []string {
+	role := roleFrom(ctx)
+	if role == "" {
+		role = defaultRole
+	}
+	return append(append([]string{}, requested...), roleRedactions[role]...)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ======================
+// 📊 Prometheus Metrics (local mode)
+// ======================
+
+// Lambda mode reports through EMF (see recordMetric); these only exist for
+// the Gin server, e.g. during load tests.
+var (
+	promOnce        sync.Once
+	promRequests    *prometheus.CounterVec
+	promDurations   *prometheus.HistogramVec
+	promRegisterErr error
+)
+
+// registerPrometheus creates the collectors once. A collector already
+// registered by an earlier setup (hot reload, tests) is reused rather than
+// failing on the duplicate.
+func registerPrometheus() error {
+	promOnce.Do(func() {
+		promRequests = registerOrReuse(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "s3json_requests_total",
+			Help: "Dispatched requests by action and HTTP status.",
+		}, []string{"action", "status"}))
+		promDurations = registerOrReuse(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "s3json_request_duration_seconds",
+			Help:    "Dispatch latency by action and HTTP status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"action", "status"}))
+	})
+	return promRegisterErr
+}
+
+func registerOrReuse[T prometheus.Collector](c T) T {
+	err := prometheus.Register(c)
+	var already prometheus.AlreadyRegisteredError
+	switch {
+	case err == nil:
+		return c
+	case errors.As(err, &already):
+		if existing, ok := already.ExistingCollector.(T); ok {
+			return existing
+		}
+	}
+	if promRegisterErr == nil {
+		promRegisterErr = err
+	}
+	return c
+}
+
+// observeDispatch records one dispatch; a no-op outside local mode. Actions
+// are bounded like EMF's (see metricAction).
+func observeDispatch(action string, status int, dur time.Duration) {
+	if !localMode || promRequests == nil {
+		return
+	}
+	action = metricAction(action)
+	code := strconv.Itoa(status)
+	promRequests.WithLabelValues(action, code).Inc()
+	promDurations.WithLabelValues(action, code).Observe(dur.Seconds())
+}
+
+func metricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// ======================
+// 🚦 Rate Limiting (Gin)
+// ======================
+
+// Requests per second and burst allowed per client IP on the local server
+// (RATE_LIMIT_RPS, RATE_LIMIT_BURST). Zero RPS disables limiting; on Lambda
+// API Gateway throttles instead.
+var (
+	rateLimitRPS   float64
+	rateLimitBurst = 10
+)
+
+func loadRateLimitConfig() {
+	if v := os.Getenv("RATE_LIMIT_RPS"); v != "" {
+		rps, err := strconv.ParseFloat(v, 64)
+		if err != nil || rps < 0 {
+			log.Fatalf("❌ RATE_LIMIT_RPS must be a non-negative number")
+		}
+		rateLimitRPS = rps
+	}
+	if v := os.Getenv("RATE_LIMIT_BURST"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("❌ RATE_LIMIT_BURST must be a positive integer")
+		}
+		rateLimitBurst = n
+	}
+}
+
+// ipLimiter hands out one token bucket per client IP. Buckets idle long
+// enough to have refilled are dropped, so a stream of one-off IPs can't grow
+// the map forever; a returning client just gets a fresh, equally full one.
+type ipLimiter struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	idleTTL   time.Duration
+	lastSweep time.Time
+	limiters  map[string]*ipBucket
+}
+
+type ipBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Lower bound on how long an idle bucket is kept
+const minLimiterIdleTTL = 3 * time.Minute
+
+func newIPLimiter(rps float64, burst int) *ipLimiter {
+	// Evicting before a bucket refills would hand back tokens early
+	refill := time.Duration(float64(burst) / rps * float64(time.Second))
+	return &ipLimiter{
+		limit:     rate.Limit(rps),
+		burst:     burst,
+		idleTTL:   max(minLimiterIdleTTL, refill),
+		lastSweep: time.Now(),
+		limiters:  map[string]*ipBucket{},
+	}
+}
+
+func (l *ipLimiter) allow(ip string) bool {
+	now := time.Now()
+
+	l.mu.Lock()
+	if now.Sub(l.lastSweep) >= l.idleTTL {
+		l.evictIdle(now)
+	}
+	bucket, ok := l.limiters[ip]
+	if !ok {
+		bucket = &ipBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[ip] = bucket
+	}
+	bucket.lastSeen = now
+	l.mu.Unlock()
+
+	return bucket.limiter.AllowN(now, 1)
+}
+
+// evictIdle drops buckets unused for idleTTL; callers hold mu.
+func (l *ipLimiter) evictIdle(now time.Time) {
+	for ip, bucket := range l.limiters {
+		if now.Sub(bucket.lastSeen) >= l.idleTTL {
+			delete(l.limiters, ip)
+		}
+	}
+	l.lastSweep = now
+}
+
+// rateLimitMiddleware answers 429 once a client IP exhausts its bucket.
+func rateLimitMiddleware(rps float64, burst int) gin.HandlerFunc {
+	if rps <= 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	limiter := newIPLimiter(rps, burst)
+	return func(c *gin.Context) {
+		if !limiter.allow(c.ClientIP()) {
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(429, gin.H{"error": "rate limit exceeded"})
+			return
+		}
+		c.Next()
+	}
+}
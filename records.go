@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ======================
+// 🧾 Generic Records
+// ======================
+
+// Record is an arbitrary JSON object, used instead of Message when
+// RECORD_MODE=generic so the service can store tasks, events, etc.
+type Record map[string]any
+
+var (
+	// "message" (default) keeps the typed Message API; "generic" stores Records
+	recordMode = "message"
+	// Field holding the auto-assigned numeric ID
+	recordIDField = "id"
+	// Fields every added record must carry
+	recordRequiredFields []string
+)
+
+func loadRecordConfig() {
+	if mode := os.Getenv("RECORD_MODE"); mode != "" {
+		if mode != "message" && mode != "generic" {
+			log.Fatalf("❌ RECORD_MODE must be message or generic")
+		}
+		recordMode = mode
+	}
+	if field := os.Getenv("RECORD_ID_FIELD"); field != "" {
+		recordIDField = field
+	}
+	for _, field := range strings.Split(os.Getenv("RECORD_REQUIRED_FIELDS"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			recordRequiredFields = append(recordRequiredFields, field)
+		}
+	}
+}
+
+// recordID reads the numeric ID; JSON numbers decode as float64.
+func (r Record) recordID() int {
+	switch id := r[recordIDField].(type) {
+	case float64:
+		return int(id)
+	case int:
+		return id
+	}
+	return 0
+}
+
+func (r Record) deleted() bool {
+	deleted, _ := r["deleted"].(bool)
+	return deleted
+}
+
+func findRecordIndex(records []Record, id int) int {
+	for i, r := range records {
+		if r.recordID() == id && !r.deleted() {
+			return i
+		}
+	}
+	return -1
+}
+
+func validateRecord(r Record) map[string]string {
+	fields := map[string]string{}
+	for _, name := range recordRequiredFields {
+		if v, ok := r[name]; !ok || v == nil || v == "" {
+			fields[name] = "required"
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// ======================
+// 📤 S3: Get Records
+// ======================
+
+// getS3Records is the Record counterpart of getS3JSON (without the cache).
+func getS3Records(ctx context.Context, s3Client *s3.Client, bucket, s3Key string) ([]Record, string, error) {
+	logger := loggerFrom(ctx).With("bucket", bucket, "key", s3Key)
+	logger.Info("s3 get records")
+
+	_, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(s3Key),
+	})
+	if err != nil {
+		if isS3NotFoundErr(err) {
+			return []Record{}, "", nil
+		}
+		logger.Error("s3 head failed", "error", err)
+		return nil, "", fmt.Errorf("head failed: %v", err)
+	}
+
+	resp, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(s3Key),
+	})
+	if err != nil {
+		logger.Error("s3 get failed", "error", err)
+		return nil, "", fmt.Errorf("get failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var records []Record
+	if err := decodeS3Body(ctx, s3Client, bucket, s3Key, resp, &records); err != nil {
+		return nil, "", err
+	}
+	return records, aws.ToString(resp.ETag), nil
+}
+
+// loadRecords is getS3Records under s3Call's deadline and span, like the
+// Store methods.
+func loadRecords(ctx context.Context, s3Key string) (records []Record, etag string, err error) {
+	err = s3Call(ctx, "getS3Records", s3Key, func(ctx context.Context) error {
+		records, etag, err = getS3Records(ctx, s3Client, bucketFrom(ctx), s3Key)
+		return err
+	})
+	return records, etag, err
+}
+
+// modifyRecords is modifyMessages for generic records; with dryRun nothing
+// is written.
+func modifyRecords(ctx context.Context, s3Key string, dryRun bool, modify func([]Record) ([]Record, error)) error {
+	defer lockFile(bucketFrom(ctx) + "/" + s3Key)()
+
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		records, etag, err := loadRecords(ctx, s3Key)
+		if err != nil {
+			return fmt.Errorf("get failed: %w", err)
+		}
+
+		updated, err := modify(records)
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			return nil
+		}
+
+		err = s3Call(ctx, "putS3JSON", s3Key, func(ctx context.Context) error {
+			return putS3JSON(ctx, s3Client, bucketFrom(ctx), s3Key, updated, etag)
+		})
+		if errors.Is(err, ErrPreconditionFailed) {
+			continue
+		}
+		return err
+	}
+
+	return errConcurrentModification
+}
+
+// ======================
+// 🧠 Record Actions
+// ======================
+
+// handleRecordAction serves get/add/update/delete in generic mode. Records
+// always live in S3; the Store abstraction only covers typed messages.
+func handleRecordAction(ctx context.Context, input APIRequest, s3Key string) (int, interface{}) {
+	switch input.Action {
+	case "get":
+		records, _, err := loadRecords(ctx, s3Key)
+		if err != nil {
+			return readError(err)
+		}
+
+		live := []Record{}
+		for _, r := range records {
+			if input.IncludeDeleted || !r.deleted() {
+				live = append(live, r)
+			}
+		}
+		return successResponse(live)
+
+	case "add":
+		if input.Record == nil {
+			return clientError(400, "Missing 'record' for add")
+		}
+		if fields := validateRecord(input.Record); fields != nil {
+			return validationError(fields)
+		}
+		fields, err := validateSchema(ctx, input.Record)
+		if err != nil {
+			return clientError(500, err.Error())
+		}
+		if len(fields) > 0 {
+			return validationError(fields)
+		}
+
+		var added Record
+		err = modifyRecords(ctx, s3Key, input.DryRun, func(records []Record) ([]Record, error) {
+			maxID := 0
+			for _, r := range records {
+				if id := r.recordID(); id > maxID {
+					maxID = id
+				}
+			}
+
+			added = Record{}
+			for k, v := range input.Record {
+				added[k] = v
+			}
+			added[recordIDField] = maxID + 1
+			delete(added, "deleted")
+
+			return append(records, added), nil
+		})
+		if err != nil {
+			return mutationError(err)
+		}
+
+		if input.DryRun {
+			return dryRunResponse("created", added)
+		}
+		recordAudit(ctx, AuditEntry{Action: input.Action, Filename: input.Filename, MessageID: added.recordID()})
+		return createdResponse(added, messageLocation(input.Filename, strconv.Itoa(added.recordID())))
+
+	case "update":
+		if input.ID <= 0 {
+			return clientError(400, "Missing or invalid 'id' for update")
+		}
+		if input.Record == nil {
+			return clientError(400, "Missing 'record' for update")
+		}
+
+		var updated Record
+		err := modifyRecords(ctx, s3Key, input.DryRun, func(records []Record) ([]Record, error) {
+			idx := findRecordIndex(records, input.ID)
+			if idx == -1 {
+				return nil, errMessageNotFound
+			}
+
+			// Merge sent fields; the ID and tombstone flag are server-owned
+			merged := Record{}
+			for k, v := range records[idx] {
+				if k != recordIDField && k != "deleted" {
+					merged[k] = v
+				}
+			}
+			for k, v := range input.Record {
+				if k != recordIDField && k != "deleted" {
+					merged[k] = v
+				}
+			}
+
+			// Validated like add: the merged record, without server fields
+			if fields := validateRecord(merged); fields != nil {
+				return nil, &patchValidationError{fields: fields}
+			}
+			fields, err := validateSchema(ctx, merged)
+			if err != nil {
+				return nil, err
+			}
+			if len(fields) > 0 {
+				return nil, &patchValidationError{fields: fields}
+			}
+
+			for k, v := range input.Record {
+				if k != recordIDField && k != "deleted" {
+					records[idx][k] = v
+				}
+			}
+			updated = records[idx]
+			return records, nil
+		})
+		var invalid *patchValidationError
+		if errors.As(err, &invalid) {
+			return validationError(invalid.fields)
+		}
+		if err != nil {
+			return mutationError(err)
+		}
+
+		if input.DryRun {
+			return dryRunResponse("updated", updated)
+		}
+		recordAudit(ctx, AuditEntry{Action: input.Action, Filename: input.Filename, MessageID: input.ID})
+		return successResponse(updated)
+
+	case "delete":
+		if input.ID <= 0 {
+			return clientError(400, "Missing or invalid 'id' for delete")
+		}
+
+		err := modifyRecords(ctx, s3Key, input.DryRun, func(records []Record) ([]Record, error) {
+			idx := findRecordIndex(records, input.ID)
+			if idx == -1 {
+				return nil, errMessageNotFound
+			}
+			records[idx]["deleted"] = true
+			return records, nil
+		})
+		if err != nil {
+			return mutationError(err)
+		}
+
+		if input.DryRun {
+			return dryRunResponse("deleted", map[string]int{"id": input.ID})
+		}
+		recordAudit(ctx, AuditEntry{Action: input.Action, Filename: input.Filename, MessageID: input.ID})
+		return successResponse(APIResponse{
+			Status: "deleted",
+			Data:   map[string]int{"id": input.ID},
+		})
+
+	default:
+		return clientError(400, "Invalid action for generic records. Use: get, add, update, delete")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// ======================
+// 📐 JSON Schema
+// ======================
+
+var (
+	// Local path to a schema bundled with the deployment (SCHEMA_FILE), or a
+	// key in S3_BUCKET_NAME (SCHEMA_S3_KEY); neither means no schema checks.
+	schemaFile  string
+	schemaS3Key string
+
+	// Guards compiledSchema, which is only set once a load succeeds
+	schemaMu       sync.Mutex
+	compiledSchema *jsonschema.Schema
+)
+
+func loadSchemaConfig() {
+	schemaFile = os.Getenv("SCHEMA_FILE")
+	schemaS3Key = os.Getenv("SCHEMA_S3_KEY")
+	if schemaFile != "" && schemaS3Key != "" {
+		log.Fatalf("❌ Set only one of SCHEMA_FILE and SCHEMA_S3_KEY")
+	}
+}
+
+// loadSchema compiles the schema on first use; the S3 client only exists
+// once main has run, so this can't happen in init. Failures aren't cached:
+// a transient S3 error fails this request, and the next one tries again.
+func loadSchema(ctx context.Context) (*jsonschema.Schema, error) {
+	if schemaFile == "" && schemaS3Key == "" {
+		return nil, nil
+	}
+
+	schemaMu.Lock()
+	defer schemaMu.Unlock()
+	if compiledSchema != nil {
+		return compiledSchema, nil
+	}
+
+	var raw []byte
+	var err error
+	if schemaFile != "" {
+		raw, err = os.ReadFile(schemaFile)
+	} else {
+		s3Ctx, cancel := withS3Timeout(ctx)
+		defer cancel()
+		raw, _, err = readS3Object(s3Ctx, s3Client, bucketName, schemaS3Key)
+		if err == nil && raw == nil {
+			err = fmt.Errorf("s3://%s/%s not found", bucketName, schemaS3Key)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("schema load failed: %v", err)
+	}
+
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("schema parse failed: %v", err)
+	}
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource("schema.json", doc); err != nil {
+		return nil, fmt.Errorf("schema parse failed: %v", err)
+	}
+	schema, err := compiler.Compile("schema.json")
+	if err != nil {
+		return nil, err
+	}
+	compiledSchema = schema
+	return schema, nil
+}
+
+// validateSchema checks v against the configured schema and returns the
+// problems keyed by field path (e.g. "sender", "meta.tags.0"), or nil.
+func validateSchema(ctx context.Context, v any) (map[string]string, error) {
+	schema, err := loadSchema(ctx)
+	if schema == nil || err != nil {
+		return nil, err
+	}
+
+	// Round-trip through JSON so the validator sees plain maps and numbers
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	validationErr, ok := schema.Validate(doc).(*jsonschema.ValidationError)
+	if !ok {
+		return nil, nil
+	}
+
+	fields := map[string]string{}
+	for _, unit := range validationErr.BasicOutput().Errors {
+		if unit.Error == nil {
+			continue
+		}
+		field := strings.ReplaceAll(strings.TrimPrefix(unit.InstanceLocation, "/"), "/", ".")
+		if field == "" {
+			field = "(root)"
+		}
+		if _, seen := fields[field]; !seen {
+			fields[field] = unit.Error.String()
+		}
+	}
+	return fields, nil
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ======================
+// 🗄️ Storage Backend
+// ======================
+
+// ObjectMeta describes the stored version of a file; zero when it's missing.
+type ObjectMeta struct {
+	ETag         string
+	LastModified time.Time
+}
+
+// ObjectInfo is one entry of a listing.
+type ObjectInfo struct {
+	Key          string
+	Size         int64 // Stored bytes (compressed, for S3)
+	LastModified time.Time
+}
+
+// Store loads and saves the message list stored under a key.
+type Store interface {
+	// Get returns the messages and their version; meta.ETag is the version
+	// tag accepted by Put.
+	Get(ctx context.Context, key string) (AllMessages, ObjectMeta, error)
+	// Put saves the messages. A non-empty version makes the write conditional
+	// and fails with ErrPreconditionFailed when the file has changed since;
+	// versionAbsent fails if the file exists at all.
+	Put(ctx context.Context, key string, messages AllMessages, version string) error
+	// Scan returns only the messages accepted by keep, without holding the
+	// whole file in memory where the backend allows it.
+	Scan(ctx context.Context, key string, keep func(Message) bool) (AllMessages, error)
+	// Tail returns the last n messages accepted by keep, oldest first.
+	Tail(ctx context.Context, key string, n int, keep func(Message) bool) (AllMessages, error)
+	// Copy duplicates src as dst. Without overwrite an existing dst fails
+	// with ErrFileExists; a missing src fails with ErrFileNotFound.
+	Copy(ctx context.Context, src, dst string, overwrite bool) error
+	// Delete removes the file, or returns ErrFileNotFound if there is none.
+	Delete(ctx context.Context, key string) error
+	// Head returns the file's metadata without loading it.
+	Head(ctx context.Context, key string) (ObjectMeta, error)
+	// List describes every stored file whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// Append adds data to the end of a plain-text object such as the audit log.
+	Append(ctx context.Context, key string, data []byte) error
+	// Ping checks the backend is reachable.
+	Ping(ctx context.Context) error
+}
+
+var store Store
+
+// diffPutter is a Store whose writes go item by item, so a write can diff
+// against the messages the caller already read instead of reading them again.
+type diffPutter interface {
+	// PutDiff is Put conditional on version, given previous: the messages
+	// Get returned along with it. An empty version means the file was missing.
+	PutDiff(ctx context.Context, key string, previous, messages AllMessages, version string) error
+}
+
+// versionAbsent as Put's version means "create only": like HTTP
+// If-None-Match: *, the write fails if the file already exists.
+const versionAbsent = "*"
+
+// ======================
+// ☁️ S3 Store
+// ======================
+
+// S3Store reads the target bucket from the context (see withBucket), falling
+// back to S3_BUCKET_NAME.
+type S3Store struct {
+	client *s3.Client
+	// Reads of a file fall back to this replica client when the primary
+	// fails with a server error or timeout; nil disables failover
+	failover *s3.Client
+}
+
+func NewS3Store(client *s3.Client) *S3Store {
+	return &S3Store{client: client}
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (AllMessages, ObjectMeta, error) {
+	var messages AllMessages
+	var meta ObjectMeta
+	err := s.read(ctx, "getS3JSON", key, func(ctx context.Context, client *s3.Client, bucket string) (err error) {
+		messages, meta, err = getS3JSON(ctx, client, bucket, key)
+		return err
+	})
+	if err != nil {
+		return nil, ObjectMeta{}, err
+	}
+	return messages, meta, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, messages AllMessages, version string) error {
+	return s.call(ctx, "putS3JSON", key, func(ctx context.Context) error {
+		return putS3JSON(ctx, s.client, bucketFrom(ctx), key, messages, version)
+	})
+}
+
+func (s *S3Store) Scan(ctx context.Context, key string, keep func(Message) bool) (AllMessages, error) {
+	var messages AllMessages
+	err := s.read(ctx, "streamS3JSON", key, func(ctx context.Context, client *s3.Client, bucket string) (err error) {
+		messages, err = streamS3JSON(ctx, client, bucket, key, keep)
+		return err
+	})
+	return messages, err
+}
+
+func (s *S3Store) Tail(ctx context.Context, key string, n int, keep func(Message) bool) (AllMessages, error) {
+	var messages AllMessages
+	err := s.read(ctx, "tailS3JSON", key, func(ctx context.Context, client *s3.Client, bucket string) (err error) {
+		messages, err = tailS3JSON(ctx, client, bucket, key, n, keep)
+		return err
+	})
+	return messages, err
+}
+
+func (s *S3Store) Copy(ctx context.Context, src, dst string, overwrite bool) error {
+	return s.call(ctx, "copyS3Object", src, func(ctx context.Context) error {
+		return copyS3Object(ctx, s.client, bucketFrom(ctx), src, dst, overwrite)
+	})
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	return s.call(ctx, "deleteS3Object", key, func(ctx context.Context) error {
+		return deleteS3Object(ctx, s.client, bucketFrom(ctx), key)
+	})
+}
+
+func (s *S3Store) Head(ctx context.Context, key string) (ObjectMeta, error) {
+	var meta ObjectMeta
+	err := s.read(ctx, "headS3Object", key, func(ctx context.Context, client *s3.Client, bucket string) (err error) {
+		meta, err = headS3Object(ctx, client, bucket, key)
+		return err
+	})
+	return meta, err
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := s.call(ctx, "listS3Keys", prefix, func(ctx context.Context) (err error) {
+		objects, err = listS3Keys(ctx, s.client, bucketFrom(ctx), prefix)
+		return err
+	})
+	return objects, err
+}
+
+func (s *S3Store) Append(ctx context.Context, key string, data []byte) error {
+	return s.call(ctx, "appendS3Object", key, func(ctx context.Context) error {
+		return appendS3Object(ctx, s.client, bucketFrom(ctx), key, data)
+	})
+}
+
+func (s *S3Store) Ping(ctx context.Context) error {
+	return s.call(ctx, "headS3Bucket", "", func(ctx context.Context) error {
+		return headS3Bucket(ctx, s.client, bucketFrom(ctx))
+	})
+}
+
+func (s *S3Store) call(ctx context.Context, name, key string, fn func(context.Context) error) error {
+	return s3Call(ctx, name, key, fn)
+}
+
+// read is call for a read of key that may fail over: when the primary fails
+// in a way isFailoverErr deems regional, fn runs again against the replica.
+// Only reads fail over; writes keep going to the primary.
+func (s *S3Store) read(ctx context.Context, name, key string, fn func(ctx context.Context, client *s3.Client, bucket string) error) error {
+	err := s.call(ctx, name, key, func(ctx context.Context) error {
+		return fn(ctx, s.client, bucketFrom(ctx))
+	})
+	if err == nil || s.failover == nil || !isFailoverErr(err) {
+		return err
+	}
+
+	loggerFrom(ctx).Warn("s3 read failing over", "op", name, "key", key, "region", s.failover.Options().Region, "error", err)
+	failoverErr := s.call(ctx, name+".failover", key, func(ctx context.Context) error {
+		return fn(ctx, s.failover, firstNonEmpty(s3FailoverBucket, bucketFrom(ctx)))
+	})
+	if failoverErr != nil {
+		return err // The primary's error is the one to report
+	}
+	return nil
+}
+
+// s3Call runs one S3 operation in its own span and under its own deadline
+// (see withS3Timeout). Running out of time surfaces as ErrStorageTimeout
+// whatever error the SDK wrapped it in.
+func s3Call(ctx context.Context, name, key string, fn func(context.Context) error) error {
+	ctx, cancel := withS3Timeout(ctx)
+	defer cancel()
+
+	err := withSpan(ctx, name, key, fn)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrStorageTimeout
+	}
+	return err
+}
+
+// isFailoverErr reports whether a primary read failure could be regional: a
+// timeout, a 5xx, or no HTTP response at all. 4xx answers are authoritative.
+func isFailoverErr(err error) bool {
+	if errors.Is(err, ErrStorageTimeout) {
+		return true
+	}
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.HTTPStatusCode() >= 500
+	}
+	var corruptErr *CorruptFileError
+	return !errors.As(err, &corruptErr)
+}
+
+// ======================
+// 🧪 Memory Store
+// ======================
+
+// MemoryStore keeps files in a map; handy for tests and offline development.
+type MemoryStore struct {
+	mu       sync.Mutex
+	files    map[string]AllMessages
+	blobs    map[string][]byte // Append-only objects
+	versions map[string]int
+	modified map[string]time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		files:    map[string]AllMessages{},
+		blobs:    map[string][]byte{},
+		versions: map[string]int{},
+		modified: map[string]time.Time{},
+	}
+}
+
+func (m *MemoryStore) Get(ctx context.Context, key string) (AllMessages, ObjectMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messages, ok := m.files[key]
+	if !ok {
+		return AllMessages{}, ObjectMeta{}, nil // Same as S3: missing file → empty array
+	}
+	meta := ObjectMeta{
+		ETag:         strconv.Itoa(m.versions[key]),
+		LastModified: m.modified[key],
+	}
+	return append(AllMessages{}, messages...), meta, nil
+}
+
+func (m *MemoryStore) Put(ctx context.Context, key string, messages AllMessages, version string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, exists := m.files[key]
+	if version == versionAbsent && exists {
+		return ErrPreconditionFailed
+	}
+	if version != "" && version != versionAbsent && version != strconv.Itoa(m.versions[key]) {
+		return ErrPreconditionFailed
+	}
+
+	m.files[key] = append(AllMessages{}, messages...)
+	m.versions[key]++
+	m.modified[key] = time.Now().UTC()
+	return nil
+}
+
+func (m *MemoryStore) Scan(ctx context.Context, key string, keep func(Message) bool) (AllMessages, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	matches := AllMessages{}
+	for _, msg := range m.files[key] {
+		if keep(msg) {
+			matches = append(matches, msg)
+		}
+	}
+	return matches, nil
+}
+
+func (m *MemoryStore) Tail(ctx context.Context, key string, n int, keep func(Message) bool) (AllMessages, error) {
+	matches, err := m.Scan(ctx, key, keep)
+	if err != nil {
+		return nil, err
+	}
+	return lastMessages(matches, n), nil
+}
+
+func (m *MemoryStore) Copy(ctx context.Context, src, dst string, overwrite bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messages, ok := m.files[src]
+	if !ok {
+		return ErrFileNotFound
+	}
+	if _, exists := m.files[dst]; exists && !overwrite {
+		return ErrFileExists
+	}
+	m.files[dst] = append(AllMessages{}, messages...)
+	m.versions[dst]++
+	m.modified[dst] = time.Now().UTC()
+	return nil
+}
+
+func (m *MemoryStore) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[key]; !ok {
+		return ErrFileNotFound
+	}
+	delete(m.files, key)
+	delete(m.modified, key) // versions keeps counting so stale ETags never match
+	return nil
+}
+
+func (m *MemoryStore) Head(ctx context.Context, key string) (ObjectMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[key]; !ok {
+		return ObjectMeta{}, nil
+	}
+	return ObjectMeta{
+		ETag:         strconv.Itoa(m.versions[key]),
+		LastModified: m.modified[key],
+	}, nil
+}
+
+func (m *MemoryStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	objects := []ObjectInfo{}
+	for key, messages := range m.files {
+		if strings.HasPrefix(key, prefix) {
+			data, _ := json.Marshal(messages)
+			objects = append(objects, ObjectInfo{Key: key, Size: int64(len(data)), LastModified: m.modified[key]})
+		}
+	}
+	// S3 lists keys in lexicographic order
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (m *MemoryStore) Append(ctx context.Context, key string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.blobs[key] = append(m.blobs[key], data...)
+	return nil
+}
+
+func (m *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
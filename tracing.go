@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ======================
+// 🛰️ Tracing (OpenTelemetry)
+// ======================
+
+var (
+	tracer = otel.Tracer("github.com/suk-chanthea/s3-json-lambda")
+
+	// nil when no exporter is configured; the global provider is then a no-op
+	tracerProvider *sdktrace.TracerProvider
+)
+
+// initTracing exports spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT
+// (or the traces-specific variant) is set; the exporter reads the endpoint
+// from the environment itself.
+func initTracing(ctx context.Context) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		slog.Error("otlp exporter init failed, tracing disabled", "error", err)
+		return
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(tracerProvider)
+}
+
+// flushTraces pushes buffered spans before Lambda freezes the sandbox.
+func flushTraces(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	if err := tracerProvider.ForceFlush(ctx); err != nil {
+		slog.Error("trace flush failed", "error", err)
+	}
+}
+
+// extractTraceContext continues the caller's trace from its traceparent
+// header. Header names are lower-cased since API Gateway keeps client casing.
+func extractTraceContext(ctx context.Context, headers map[string]string) context.Context {
+	carrier := propagation.MapCarrier{}
+	for k, v := range headers {
+		carrier[strings.ToLower(k)] = v
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+// withSpan runs fn inside a child span named name for the given S3 key.
+func withSpan(ctx context.Context, name, key string, fn func(context.Context) error) error {
+	ctx, span := tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.String("s3.bucket", bucketFrom(ctx)),
+		attribute.String("s3.key", key),
+	))
+	defer span.End()
+
+	err := fn(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}